@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,11 +20,9 @@ func generate(w http.ResponseWriter, args map[string]interface{}, templatePaths
 	t = t.Funcs(funcs)
 	httpCheck(err)
 	paths := append([]string{"t/admin.html"}, templatePaths...)
+	assets := assetFS()
 	for _, path := range paths {
-		f, err := fsys.Open("assets/" + path)
-		httpCheck(err)
-		defer f.Close()
-		templ, err := io.ReadAll(f)
+		templ, err := fs.ReadFile(assets, path)
 		httpCheck(err)
 		t, err = t.Parse(string(templ))
 		httpCheck(err)
@@ -59,6 +61,18 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		return tm
 	}
 
+	// Empty means no time.
+	parseOptTime := func(what, s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			abortUserError(fmt.Sprintf("Bad %s time, must be like 2006-01-02T15:04:05Z or empty.", what))
+		}
+		return tm
+	}
+
 	setAuthCookie := func() {
 		value := generateAuth([]byte(config.CookieAuthKey + config.Password))
 		cookie := &http.Cookie{Name: "auth", Value: value, Path: baseURL.Path, MaxAge: 12 * 3600, Secure: config.SecureCookies, HttpOnly: true}
@@ -70,9 +84,6 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		http.SetCookie(w, cookie)
 	}
 
-	data, err := readStore()
-	httpCheck(err)
-
 	cmd := elems[0]
 	args := map[string]interface{}{}
 	if cmd != "login" {
@@ -95,19 +106,52 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		setAuthCookie()
 	}
 
+	// Mutations read the store and write it back while holding the lock, so
+	// concurrent saves cannot interleave. They work on a private copy of the
+	// store read from disk, other requests use the shared in-memory store.
+	var data *store
+	var err error
+	if r.Method == "POST" {
+		storeLock.Lock()
+		defer storeLock.Unlock()
+		defer storeChanged()
+		data, err = readStore()
+	} else {
+		data, err = loadStore()
+	}
+	httpCheck(err)
+
 	switch cmd {
 	case "index":
 		needGet(r)
 		paramsNeed(0)
 		args["posts"] = data.Posts
+		args["pages"] = data.Pages
+		args["errors"] = data.Errors
 		generate(w, args, "t/admin/index.html")
 
 	case "post":
 		needGet(r)
 		paramsNeed(1)
-		args["post"] = data.post(params[0])
+		p := data.post(params[0])
+		revs, err := readRevisions(p.ID)
+		httpCheck(err)
+		args["post"] = p
+		args["version"] = postVersion(p)
+		args["revisions"] = revs
 		generate(w, args, "t/admin/post.html")
 
+	case "revision":
+		needGet(r)
+		paramsNeed(2)
+		p := data.post(params[0])
+		rev := findRevision(p.ID, params[1])
+		args["post"] = p
+		args["version"] = postVersion(p)
+		args["revision"] = rev
+		args["diff"] = lineDiff(p.Body, rev.Post.Body)
+		generate(w, args, "t/admin/revision.html")
+
 	case "post-create":
 		needPost(r)
 		paramsNeed(0)
@@ -131,6 +175,7 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		needPost(r)
 		paramsNeed(1)
 		p := data.post(params[0])
+		current := *p
 		p.Active = r.PostFormValue("active") != ""
 		slug := r.PostFormValue("slug")
 		if slug == "" {
@@ -140,16 +185,94 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		if slug != p.Slug && data.findPostBySlug(slug) != nil {
 			abortUserError("New slug already exists.")
 		}
+		if slug != p.Slug {
+			// Links to the old slug keep working through a redirect.
+			oldSlugs := []string{}
+			for _, s := range append(p.OldSlugs, p.Slug) {
+				if s != slug {
+					oldSlugs = append(oldSlugs, s)
+				}
+			}
+			p.OldSlugs = oldSlugs
+		}
 		p.Slug = slug
 		p.Title = r.PostFormValue("title")
 		p.Time = parseTime(r.PostFormValue("time"))
+		p.Publish = parseOptTime("publish", r.PostFormValue("publish"))
+		p.Expire = parseOptTime("expire", r.PostFormValue("expire"))
+		if !p.Publish.IsZero() && !p.Expire.IsZero() && !p.Expire.After(p.Publish) {
+			abortUserError("Expire time must be after publish time.")
+		}
+		p.Updated = time.Now()
+		p.Author = r.PostFormValue("author")
+		p.Tags, err = parseTags(r.PostFormValue("tags"))
+		if err != nil {
+			abortUserError(err.Error())
+		}
+		p.Summary = strings.Join(strings.Fields(r.PostFormValue("summary")), " ")
+		p.PageBudget = 0
+		if s := strings.TrimSpace(r.PostFormValue("pagebudget")); s != "" {
+			p.PageBudget, err = strconv.Atoi(s)
+			if err != nil {
+				abortUserError("Bad page budget, must be a number or empty.")
+			}
+		}
+		p.LegacyTemplates = r.PostFormValue("legacytemplates") != ""
 		p.Body = r.PostFormValue("body")
+		if err := checkBody(data, "", p.Summary, p.LegacyTemplates); err != nil {
+			abortUserError("Summary has errors: " + err.Error())
+		}
+		if err := checkBody(data, "", p.Body, p.LegacyTemplates); err != nil {
+			abortUserError("Body has errors: " + err.Error())
+		}
+		if err := checkMarkdownRefs(data, p.Summary); err != nil {
+			abortUserError("Summary has bad references: " + err.Error())
+		}
+		if err := checkMarkdownRefs(data, p.Body); err != nil {
+			abortUserError("Body has bad references: " + err.Error())
+		}
+		if r.PostFormValue("version") != postVersion(&current) {
+			// Saved by someone else since the form was loaded, don't overwrite their changes.
+			args["post"] = &current
+			args["version"] = postVersion(&current)
+			args["mine"] = p
+			args["diff"] = lineDiff(current.Body, p.Body)
+			cthtml(w)
+			w.WriteHeader(http.StatusConflict)
+			generate(w, args, "t/admin/conflict.html")
+			return
+		}
+		err = saveRevision(p.ID)
+		httpCheck(err)
 		err = writePost(p)
 		httpCheck(err)
 		if p.Slug != oldSlug {
 			removeWritethrough(fmt.Sprintf("data/www/p/%s/index.html", oldSlug))
 		}
 		removeWritethrough(fmt.Sprintf("data/www/p/%s/index.html", p.Slug))
+		if now := time.Now(); current.Published(now) != p.Published(now) {
+			// Links to the post from other posts and pages appear or disappear.
+			removeAllWritethrough()
+		}
+		http.Redirect(w, r, fmt.Sprintf("%sa/post/%s", config.BaseURL, p.ID), http.StatusSeeOther)
+
+	case "post-restore":
+		needPost(r)
+		paramsNeed(2)
+		p := data.post(params[0])
+		rev := findRevision(p.ID, params[1])
+		if r.PostFormValue("version") != postVersion(p) {
+			http.Error(w, "Post was changed since you loaded it, reload and try again.", http.StatusConflict)
+			return
+		}
+		p.Title = rev.Post.Title
+		p.Updated = time.Now()
+		p.Body = rev.Post.Body
+		err = saveRevision(p.ID)
+		httpCheck(err)
+		err = writePost(p)
+		httpCheck(err)
+		removeWritethrough(fmt.Sprintf("data/www/p/%s/index.html", p.Slug))
 		http.Redirect(w, r, fmt.Sprintf("%sa/post/%s", config.BaseURL, p.ID), http.StatusSeeOther)
 
 	case "post-delete":
@@ -168,7 +291,7 @@ func admin(w http.ResponseWriter, r *http.Request) {
 
 		cthtml(w)
 		cc, ww := compact(w)
-		httpCheck(parseTemplate("t/post.html").Execute(ww, map[string]interface{}{
+		httpCheck(parseTemplate("t/post.html").Funcs(postBudget(p).renderFuncs()).Execute(ww, map[string]interface{}{
 			"post": p,
 		}))
 		ww.Close()
@@ -203,6 +326,83 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		removeWritethrough(fmt.Sprintf("data/www/p/%s/index.html", p.Slug))
 		http.Redirect(w, r, fmt.Sprintf("%sa/post/%s", config.BaseURL, c.PostID), http.StatusSeeOther)
 
+	case "page":
+		needGet(r)
+		paramsNeed(1)
+		pg := data.page(params[0])
+		args["page"] = pg
+		args["version"] = pageVersion(pg)
+		generate(w, args, "t/admin/page.html")
+
+	case "page-create":
+		needPost(r)
+		paramsNeed(0)
+		pg := &page{
+			ID:     newID(),
+			Active: false,
+			Slug:   r.PostFormValue("slug"),
+			Title:  r.PostFormValue("title"),
+			Time:   time.Now(),
+		}
+		if err := checkPageSlug(pg.Slug); err != nil {
+			abortUserError(err.Error())
+		}
+		if data.findPageBySlug(pg.Slug) != nil {
+			abortUserError("Slug already exists.")
+		}
+		err = writePage(pg)
+		httpCheck(err)
+		http.Redirect(w, r, fmt.Sprintf("%sa/page/%s", config.BaseURL, pg.ID), http.StatusSeeOther)
+
+	case "page-save":
+		needPost(r)
+		paramsNeed(1)
+		pg := data.page(params[0])
+		if r.PostFormValue("version") != pageVersion(pg) {
+			http.Error(w, "Page was changed since you loaded it, your changes were not saved. Copy them, reload the page and try again.", http.StatusConflict)
+			return
+		}
+		slug := r.PostFormValue("slug")
+		if err := checkPageSlug(slug); err != nil {
+			abortUserError(err.Error())
+		}
+		if slug != pg.Slug && data.findPageBySlug(slug) != nil {
+			abortUserError("New slug already exists.")
+		}
+		pg.Active = r.PostFormValue("active") != ""
+		pg.Slug = slug
+		pg.Title = r.PostFormValue("title")
+		pg.Menu = 0
+		if s := r.PostFormValue("menu"); s != "" {
+			pg.Menu, err = strconv.Atoi(s)
+			if err != nil {
+				abortUserError("Bad menu position, must be a number or empty.")
+			}
+		}
+		pg.Updated = time.Now()
+		pg.LegacyTemplates = r.PostFormValue("legacytemplates") != ""
+		pg.Body = r.PostFormValue("body")
+		if err := checkBody(data, pg.Slug, pg.Body, pg.LegacyTemplates); err != nil {
+			abortUserError("Body has errors: " + err.Error())
+		}
+		if err := checkMarkdownRefs(data, pg.Body); err != nil {
+			abortUserError("Body has bad references: " + err.Error())
+		}
+		err = writePage(pg)
+		httpCheck(err)
+		// All pages link to pages in the menu.
+		removeAllWritethrough()
+		http.Redirect(w, r, fmt.Sprintf("%sa/page/%s", config.BaseURL, pg.ID), http.StatusSeeOther)
+
+	case "page-delete":
+		needPost(r)
+		paramsNeed(1)
+		pg := data.page(params[0])
+		err = deletePage(pg)
+		httpCheck(err)
+		removeAllWritethrough()
+		http.Redirect(w, r, fmt.Sprintf("%sa/index/", config.BaseURL), http.StatusSeeOther)
+
 	case "images":
 		needGet(r)
 		paramsNeed(0)
@@ -216,41 +416,138 @@ func admin(w http.ResponseWriter, r *http.Request) {
 		httpCheck(err)
 		defer f.Close()
 
-		mimetype := ""
-		var ext string
-		switch {
-		case strings.HasSuffix(fh.Filename, ".jpg"):
-			mimetype = "image/jpeg"
-			ext = "jpg"
-		case strings.HasSuffix(fh.Filename, ".png"):
-			mimetype = "image/png"
-			ext = "png"
-		case strings.HasSuffix(fh.Filename, ".gif"):
-			mimetype = "image/gif"
-			ext = "gif"
-		case strings.HasSuffix(fh.Filename, ".mp4"):
-			mimetype = "video/mp4"
-			ext = "mp4"
-		default:
+		mimetype, ext := imageFileType(fh.Filename)
+		if mimetype == "" {
 			abortUserError("Unknown image file extension, please upload a .jpg, .png, .gif or .mp4.")
 		}
 		buf, err := io.ReadAll(f)
 		httpCheck(err)
+		keepMetadata := r.FormValue("keepmetadata") != ""
+		buf, captured, err := processUpload(mimetype, buf, keepMetadata)
+		if err != nil {
+			abortUserError(fmt.Sprintf("Bad image: %v", err))
+		}
+
+		// Videos can have a poster image, shown until the video plays.
+		var poster []byte
+		var posterExt string
+		pf, pfh, err := r.FormFile("poster")
+		if err != http.ErrMissingFile {
+			httpCheck(err)
+			defer pf.Close()
+			if !strings.HasPrefix(mimetype, "video/") {
+				abortUserError("A poster can only be added to a video.")
+			}
+			var posterMimetype string
+			posterMimetype, posterExt = imageFileType(pfh.Filename)
+			if posterMimetype != "image/jpeg" && posterMimetype != "image/png" {
+				abortUserError("Unknown poster file extension, please upload a .jpg or .png.")
+			}
+			poster, err = io.ReadAll(pf)
+			httpCheck(err)
+			poster, _, err = processUpload(posterMimetype, poster, keepMetadata)
+			if err != nil {
+				abortUserError(fmt.Sprintf("Bad poster: %v", err))
+			}
+		}
+
 		img := &image{
 			ID:       newID(),
 			Time:     time.Now(),
 			Slug:     r.FormValue("slug"),
 			Title:    r.FormValue("title"),
+			Alt:      r.FormValue("alt"),
 			Mimetype: mimetype,
 			Filename: "data." + ext,
+			Captured: captured,
 		}
-		err = writeImage(img)
-		httpCheck(err)
+		if poster != nil {
+			img.Poster = "poster." + posterExt
+		}
+		// Data first, an image.txt without its data file is invalid.
 		err = writeImageData(img, buf)
 		httpCheck(err)
+		if poster != nil {
+			err = writePosterData(img, poster)
+			httpCheck(err)
+		}
+		err = writeImage(img)
+		httpCheck(err)
 
 		http.Redirect(w, r, fmt.Sprintf("%sa/images/", config.BaseURL), http.StatusSeeOther)
 
+	case "redirects":
+		needGet(r)
+		paramsNeed(0)
+		args["redirects"] = data.Redirects
+		generate(w, args, "t/admin/redirects.html")
+
+	case "redirect-create":
+		needPost(r)
+		paramsNeed(0)
+		rd := parseRedirect(r.PostFormValue("from"), r.PostFormValue("to"))
+		if data.findRedirect(rd.From) != nil {
+			abortUserError("Redirect for path already exists.")
+		}
+		err = writeRedirects(append(data.Redirects, rd))
+		httpCheck(err)
+		http.Redirect(w, r, fmt.Sprintf("%sa/redirects/", config.BaseURL), http.StatusSeeOther)
+
+	case "redirect-delete":
+		needPost(r)
+		paramsNeed(0)
+		rd := data.findRedirect(r.PostFormValue("from"))
+		if rd == nil {
+			abort(404)
+		}
+		var l []*redirect
+		for _, x := range data.Redirects {
+			if x != rd {
+				l = append(l, x)
+			}
+		}
+		err = writeRedirects(l)
+		httpCheck(err)
+		http.Redirect(w, r, fmt.Sprintf("%sa/redirects/", config.BaseURL), http.StatusSeeOther)
+
+	case "backups":
+		needGet(r)
+		paramsNeed(0)
+		dir, keep, keepDays := backupConfig()
+		l, err := listBackups(dir)
+		httpCheck(err)
+		args["backups"] = l
+		args["dir"] = dir
+		args["keep"] = keep
+		args["keepdays"] = keepDays
+		generate(w, args, "t/admin/backups.html")
+
+	case "backup-create":
+		needPost(r)
+		paramsNeed(0)
+		_, err := backupRotate(backupConfig())
+		httpCheck(err)
+		http.Redirect(w, r, fmt.Sprintf("%sa/backups/", config.BaseURL), http.StatusSeeOther)
+
+	case "backup":
+		needGet(r)
+		paramsNeed(1)
+		if _, ok := parseBackupName(params[0]); !ok {
+			abort(404)
+		}
+		dir, _, _ := backupConfig()
+		f, err := os.Open(filepath.Join(dir, params[0]))
+		if err != nil && os.IsNotExist(err) {
+			abort(404)
+		}
+		httpCheck(err)
+		defer f.Close()
+		fi, err := f.Stat()
+		httpCheck(err)
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, params[0]))
+		http.ServeContent(w, r, params[0], fi.ModTime(), f)
+
 	case "login":
 		switch r.Method {
 		case "GET":
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are gzipped tar files of the data directory, named
+// data-<time>.tar.gz, with the time of the snapshot in UTC. File names in the
+// archive start with "data/". The cached pages in data/www and cached images in
+// data/cache are left out.
+
+const backupTimeFormat = "20060102T150405.000Z"
+
+// backupConfig returns the backup directory and retention policy from the
+// config, with defaults for missing values.
+func backupConfig() (dir string, keep, keepDays int) {
+	dir, keep, keepDays = config.Backup.Dir, config.Backup.Keep, config.Backup.KeepDays
+	if dir == "" {
+		dir = "backup"
+	}
+	if keep <= 0 {
+		keep = 7
+	}
+	if keepDays <= 0 {
+		keepDays = 30
+	}
+	return
+}
+
+type backupFile struct {
+	Name string
+	Time time.Time
+	Size int64
+}
+
+// listBackups returns the backups in dir, newest first.
+func listBackups(dir string) ([]backupFile, error) {
+	l, err := os.ReadDir(dir)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var r []backupFile
+	for _, e := range l {
+		tm, ok := parseBackupName(e.Name())
+		if !ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, backupFile{e.Name(), tm, fi.Size()})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Time.After(r[j].Time)
+	})
+	return r, nil
+}
+
+func parseBackupName(name string) (time.Time, bool) {
+	s, ok := strings.CutPrefix(name, "data-")
+	if !ok {
+		return time.Time{}, false
+	}
+	s, ok = strings.CutSuffix(s, ".tar.gz")
+	if !ok {
+		return time.Time{}, false
+	}
+	tm, err := time.Parse(backupTimeFormat, s)
+	return tm, err == nil
+}
+
+// writeBackup writes a snapshot of the data directory to dir and returns its
+// name. Must be called with storeLock held, so the snapshot is consistent.
+func writeBackup(dir string) (name string, rerr error) {
+	if err := ensureDir(dir); err != nil {
+		return "", err
+	}
+	name = fmt.Sprintf("data-%s.tar.gz", time.Now().UTC().Format(backupTimeFormat))
+	f, err := os.CreateTemp(dir, "."+name+"-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if rerr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	err = filepath.WalkDir("data", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "data/www" || p == "data/cache" {
+			return fs.SkipDir
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(p)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		df, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer df.Close()
+		_, err = io.Copy(tw, df)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gzw.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return name, syncDir(dir)
+}
+
+// expiredBackups returns the backups to remove under the retention policy: the
+// keep newest backups are kept, and the newest backup of each of the last
+// keepDays days.
+func expiredBackups(l []backupFile, keep, keepDays int, now time.Time) []backupFile {
+	days := map[string]bool{}
+	cutoff := now.AddDate(0, 0, -keepDays)
+	var r []backupFile
+	for i, b := range l {
+		day := b.Time.UTC().Format("2006-01-02")
+		if i < keep || b.Time.After(cutoff) && !days[day] {
+			days[day] = true
+			continue
+		}
+		r = append(r, b)
+	}
+	return r
+}
+
+// backupRotate creates a backup and removes backups that expired.
+func backupRotate(dir string, keep, keepDays int) (string, error) {
+	name, err := writeBackup(dir)
+	if err != nil {
+		return "", fmt.Errorf("writing backup: %v", err)
+	}
+	l, err := listBackups(dir)
+	if err != nil {
+		return name, fmt.Errorf("listing backups: %v", err)
+	}
+	for _, b := range expiredBackups(l, keep, keepDays, time.Now()) {
+		if err := os.Remove(filepath.Join(dir, b.Name)); err != nil {
+			return name, fmt.Errorf("removing old backup: %v", err)
+		}
+		log.Printf("removed old backup %s", b.Name)
+	}
+	return name, nil
+}
+
+func backup(args []string) {
+	fl := flag.NewFlagSet("backup", flag.ExitOnError)
+	ddir, dkeep, dkeepDays := backupConfig()
+	dir := fl.String("dir", ddir, "Directory to write backups to")
+	keep := fl.Int("keep", dkeep, "Number of newest backups to keep")
+	keepDays := fl.Int("keepdays", dkeepDays, "Also keep the newest backup of each day for this many days")
+	fl.Usage = func() {
+		log.Printf("usage: blogx backup [flags]")
+		log.Printf("Writes a snapshot of the data directory in the current directory, taken while holding the lock that a running blogx serve takes for changes. Older backups are removed according to the retention flags.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() != 0 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	storeLock.Lock()
+	name, err := backupRotate(*dir, *keep, *keepDays)
+	storeLock.Unlock()
+	check(err, "backup")
+	log.Printf("wrote %s", filepath.Join(*dir, name))
+}
+
+func restore(args []string) {
+	fl := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryrun := fl.Bool("dryrun", false, "Only check the backup")
+	force := fl.Bool("force", false, "Restore even if files in the backup cannot be parsed")
+	fl.Usage = func() {
+		log.Printf("usage: blogx restore [-dryrun] [-force] data-<time>.tar.gz")
+		log.Printf("Replaces the data directory in the current directory with the contents of a backup, after checking the backup can be read. The current contents are moved to data.before-restore-<time>.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	args = fl.Args()
+	if len(args) != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	// Extract next to the data directory, so we can rename into place.
+	stage, err := os.MkdirTemp(".", ".restore-*")
+	check(err, "creating staging directory")
+	defer os.RemoveAll(stage)
+	fatalf := func(format string, args ...interface{}) {
+		os.RemoveAll(stage)
+		log.Fatalf(format, args...)
+	}
+	if err := extractBackup(args[0], stage); err != nil {
+		fatalf("extracting backup: %v", err)
+	}
+
+	st, err := readStoreDir(stage + "/data")
+	if err != nil {
+		fatalf("reading backup: %v", err)
+	}
+	log.Printf("backup has %d posts and %d images", len(st.Posts), len(st.Images))
+	if len(st.Errors) > 0 && !*force {
+		fatalf("backup has %d files that cannot be parsed, use -force to restore anyway", len(st.Errors))
+	}
+	if *dryrun {
+		return
+	}
+
+	check(ensureDir("data"), "creating data directory")
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	old := "data.before-restore-" + time.Now().UTC().Format(backupTimeFormat)
+	check(os.Mkdir(old, 0777), "creating directory for current data")
+	l, err := os.ReadDir("data")
+	check(err, "listing data directory")
+	for _, e := range l {
+		// Keep the lock file and the cached pages, the latter are removed below.
+		if strings.HasPrefix(e.Name(), ".") || e.Name() == "www" {
+			continue
+		}
+		check(os.Rename("data/"+e.Name(), old+"/"+e.Name()), "moving current data")
+	}
+	l, err = os.ReadDir(stage + "/data")
+	check(err, "listing backup")
+	for _, e := range l {
+		if e.Name() == "www" {
+			continue
+		}
+		check(os.Rename(stage+"/data/"+e.Name(), "data/"+e.Name()), "moving backup into place")
+	}
+	check(ensureDir("data/www"), "creating data/www")
+	check(syncDir("data"), "syncing data directory")
+	removeAllWritethrough()
+	log.Printf("restored %s, previous data moved to %s", args[0], old)
+}
+
+// extractBackup extracts the backup into dir. Only directories and regular
+// files under data/ are allowed.
+func extractBackup(filename, dir string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if name != "data" && !strings.HasPrefix(name, "data/") || strings.Contains(name, "..") {
+			return fmt.Errorf("unexpected file %q in backup", hdr.Name)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+				return err
+			}
+			df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(df, tr)
+			if err == nil {
+				err = df.Sync()
+			}
+			if xerr := df.Close(); err == nil {
+				err = xerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected file type for %q in backup", hdr.Name)
+		}
+	}
+	for _, d := range []string{"data/post", "data/image"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpiredBackups(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	var l []backupFile
+	// Two backups a day for 20 days, newest first.
+	for i := 0; i < 40; i++ {
+		tm := now.Add(-time.Duration(i) * 12 * time.Hour)
+		l = append(l, backupFile{Name: "data-" + tm.Format(backupTimeFormat) + ".tar.gz", Time: tm})
+	}
+
+	var names []string
+	for _, b := range expiredBackups(l, 3, 10, now) {
+		names = append(names, b.Name)
+	}
+	// Kept: the 3 newest, and the newest of each day within the last 10 days.
+	var xnames []string
+	for i := 3; i < 40; i++ {
+		if i%2 == 0 && i < 20 {
+			continue
+		}
+		xnames = append(xnames, l[i].Name)
+	}
+	if !reflect.DeepEqual(names, xnames) {
+		t.Fatalf("got expired %v, expected %v", names, xnames)
+	}
+
+	if r := expiredBackups(l[:2], 7, 0, now); len(r) != 0 {
+		t.Fatalf("got expired %v, expected none", r)
+	}
+}
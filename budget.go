@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	textTemplate "text/template"
+)
+
+// Images are inlined in pages, until the page budget is used up. Later images
+// are served from <baseurl>i/<slug>, with a tiny inlined placeholder shown while
+// loading. One budget is used for everything rendered into a page, e.g. all
+// summaries on the index. Images from inlineImage in templates count first, templates are
+// executed before the markdown is rendered.
+
+// imageBudget tracks the bytes of inlined images left for a page. A nil
+// budget has no limit.
+type imageBudget struct {
+	left int
+}
+
+// newImageBudget returns a budget of n bytes, or no limit for n <= 0.
+func newImageBudget(n int) *imageBudget {
+	if n <= 0 {
+		return nil
+	}
+	return &imageBudget{n}
+}
+
+// postBudget returns the budget for the page of p.
+func postBudget(p *post) *imageBudget {
+	if p.PageBudget != 0 {
+		return newImageBudget(p.PageBudget)
+	}
+	return newImageBudget(config.PageBudget)
+}
+
+func (b *imageBudget) exhausted() bool {
+	return b != nil && b.left <= 0
+}
+
+// take subtracts n bytes from the budget if they fit. Once an image does not
+// fit, no later images are inlined either.
+func (b *imageBudget) take(n int) bool {
+	if b == nil {
+		return true
+	}
+	if n > b.left {
+		b.left = 0
+		return false
+	}
+	b.left -= n
+	return true
+}
+
+// inlineImage is like the template function inlineImage, but returns the URL of
+// the image instead of its data if it does not fit in the budget.
+func (b *imageBudget) inlineImage(o interface{}) template.URL {
+	var slug string
+	switch img := o.(type) {
+	case *Img:
+		// The image endpoint only serves scaled versions of the original, other
+		// operations like crop and rotate are always inlined.
+		if img.resizedOnly() {
+			slug = img.slug()
+		}
+	case *image:
+		slug = img.Slug
+	}
+	// Images read from a path have no slug and are always inlined.
+	if slug == "" || b == nil {
+		return inlineImage(o)
+	}
+	if !b.exhausted() {
+		if s := inlineImage(o); b.take(len(s)) {
+			return s
+		}
+	}
+	if x, ok := o.(*Img); ok {
+		dx, _ := x.size()
+		return template.URL(imageVariantURL(slug, uint(dx)))
+	}
+	return template.URL(imageURL(slug))
+}
+
+// textFuncs returns the template functions for rendering text with budget b.
+func (b *imageBudget) textFuncs() textTemplate.FuncMap {
+	m := textTemplate.FuncMap{
+		"inlineImage": b.inlineImage,
+		"figure": func(o interface{}) template.HTML {
+			return figureImage(o, b.inlineImage)
+		},
+	}
+	for k, v := range b.renderFuncs() {
+		m[k] = v
+	}
+	return m
+}
+
+// renderFuncs returns the template functions that render markdown, with budget
+// b for all images rendered into a page.
+func (b *imageBudget) renderFuncs() template.FuncMap {
+	return template.FuncMap{
+		"renderMarkdown": func(md string) (template.HTML, error) {
+			return renderBudgetMarkdown(md, false, b)
+		},
+		"renderShortMarkdown": func(md string) (template.HTML, error) {
+			return renderShortMarkdown(md, b)
+		},
+		"renderSummary": func(p *post) (template.HTML, error) {
+			return renderSummary(p, b)
+		},
+		"renderPostBody": func(p *post) (template.HTML, error) {
+			return renderBudgetMarkdown(p.Body, p.LegacyTemplates, b)
+		},
+		"renderPageBody": func(pg *page) (template.HTML, error) {
+			return renderBudgetMarkdown(pg.Body, pg.LegacyTemplates, b)
+		},
+	}
+}
+
+// writeExternalImage writes an img tag for img served from the image endpoint,
+// with an inlined placeholder as background while it loads. The image is
+// displayed scaled down to fit within width and height if non-zero.
+func writeExternalImage(out *bytes.Buffer, img *image, width, height uint, title, alt []byte) {
+	src := imageURL(img.Slug)
+	var attrs string
+	if img.Mimetype == "image/jpeg" || img.Mimetype == "image/png" {
+		x := image2img(img)
+		dx, dy := x.size()
+		width, height = fitSize(uint(dx), uint(dy), width, height)
+		src = imageVariantURL(img.Slug, width)
+		attrs = fmt.Sprintf(` width="%d" height="%d" style="background:url(%s) center / cover no-repeat"`, width, height, imagePlaceholder(x))
+	}
+	fmt.Fprintf(out, `<img src="%s" alt="%s"`, html.EscapeString(src), html.EscapeString(string(alt)))
+	if len(title) > 0 {
+		fmt.Fprintf(out, ` title="%s"`, html.EscapeString(string(title)))
+	}
+	fmt.Fprintf(out, ` loading="lazy"%s />`, attrs)
+}
+
+// imagePlaceholder returns a data URL of a tiny low quality version of img.
+func imagePlaceholder(img *Img) string {
+	t := thumbnail(24, 24, img)
+	t.quality = 30
+	return string(inlineImage(t))
+}
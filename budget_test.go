@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	imagelib "image"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPageBudget(t *testing.T) {
+	testDataDir(t)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, imagelib.NewNRGBA(imagelib.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	cat := &image{ID: "x", Slug: "cat", Title: "Cat", Mimetype: "image/png", Filename: "data.png", Time: time.Now()}
+	if err := writeImage(cat); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeImageData(cat, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	storeChanged()
+
+	// Room for one inlined image, the summaries of both posts share the budget.
+	posts := []*post{{Summary: "![a](image:cat)"}, {Summary: "![b](image:cat)"}}
+	budget := newImageBudget(len(inlineImage(cat)) + 10)
+	var b strings.Builder
+	err := parseTemplateString("index", `{{range .}}{{renderSummary .}}{{end}}`).Funcs(budget.renderFuncs()).Execute(&b, posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(b.String(), `loading="lazy"`); n != 1 {
+		t.Fatalf("got %d external images, expected 1: %s", n, b.String())
+	}
+
+	// Without limit, both are inlined.
+	b.Reset()
+	err = parseTemplateString("index", `{{range .}}{{renderSummary .}}{{end}}`).Execute(&b, posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `loading="lazy"`) {
+		t.Fatalf("got external image without budget: %s", b.String())
+	}
+
+	// With the budget used up, scaled images are served by the image endpoint,
+	// but images with other operations are still inlined.
+	budget = newImageBudget(1)
+	if s := budget.inlineImage(thumbnail(20, 0, image2img(cat))); s != "https://example.org/i/cat?w=160" {
+		t.Fatalf("inlineImage thumbnail over budget: got %q", s)
+	}
+	for _, x := range []*Img{rotate(90, image2img(cat)), crop(0, 0, 10, 10, image2img(cat)), toJPEG("#fff", image2img(cat))} {
+		if s := budget.inlineImage(x); s != inlineImage(x) {
+			t.Fatalf("inlineImage %v over budget: got %q, expected inlined", x.ops, s)
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,29 +17,47 @@ import (
 var errNoID = errors.New("no id")
 
 type store struct {
-	Posts  []*post
-	Images []*image
+	Posts     []*post
+	Pages     []*page
+	Images    []*image
+	Redirects []*redirect
+
+	Errors []error // Corrupt files that were skipped while reading.
 }
 
 type post struct {
-	ID     string
-	Active bool
-	Slug   string
-	Title  string
-	Time   time.Time
-	Body   string
+	ID       string
+	Active   bool
+	Slug     string
+	OldSlugs []string // Earlier slugs, redirected to the current slug.
+	Title    string
+	Time     time.Time // Displayed date, and order of posts.
+	Publish  time.Time // If set, an active post is only visible from this time.
+	Expire   time.Time // If set, an active post is no longer visible from this time.
+	Updated  time.Time // Time of last save, zero if never saved after creation.
+	Author   string    // If empty, the blog author.
+	Tags     []string  // Sorted, see parseTags.
+	Summary  string    // Markdown shown on the index and in feeds instead of the start of the body.
+	// Bytes of images to inline in the rendered post, overriding config
+	// PageBudget. Zero for the config value, negative for no limit.
+	PageBudget int
+	// Execute body and summary as templates, like before shortcodes.
+	LegacyTemplates bool
+	Body            string
 
 	Comments []*comment
 }
 
 type comment struct {
-	ID     string
-	PostID string
-	Active bool
-	Seen   bool
-	Time   time.Time
-	Author string
-	Body   string
+	ID        string
+	PostID    string
+	Active    bool
+	Seen      bool
+	Time      time.Time
+	Author    string
+	Address   string // IP address of the commenter, if known.
+	UserAgent string
+	Body      string
 }
 
 type image struct {
@@ -44,60 +65,118 @@ type image struct {
 	Time     time.Time
 	Slug     string
 	Title    string
+	Alt      string // Alternative text, Title is used if empty.
 	Filename string
-	Mimetype string // eg image/jpeg
+	Mimetype string    // eg image/jpeg
+	Captured time.Time // From EXIF data of the uploaded file, zero if unknown.
+	Poster   string    // Filename of the poster image of a video, optional.
+}
+
+// AltText returns the text for the alt attribute of an img tag.
+func (img *image) AltText() string {
+	if img.Alt != "" {
+		return img.Alt
+	}
+	return img.Title
 }
 
 func (img *image) Data() ([]byte, error) {
 	return os.ReadFile("data/image/" + img.ID + "/" + img.Filename)
 }
 
-func readStore() (st *store, rerr error) {
-	defer func() {
-		e := recover()
-		if e != nil {
-			ee, ok := e.(parseError)
-			if ok {
-				rerr = ee
-			} else {
-				panic(e)
-			}
-		}
-	}()
+func (img *image) PosterData() ([]byte, error) {
+	return os.ReadFile("data/image/" + img.ID + "/" + img.Poster)
+}
+
+// readStore reads all posts, comments and images from the data directory.
+// Files that cannot be parsed are skipped, the store is then degraded and
+// Errors lists each corrupt file.
+func readStore() (*store, error) {
+	return readStoreDir("data")
+}
 
-	var posts []*post
-	var images []*image
+// readStoreDir reads a store from dir, which is laid out like the data directory.
+func readStoreDir(dir string) (*store, error) {
+	st := &store{}
 
-	l, err := os.ReadDir("data/post")
+	l, err := os.ReadDir(dir + "/post")
 	if err != nil {
 		return nil, fmt.Errorf("listing posts: %s", err)
 	}
 	for _, fi := range l {
-		dir := "data/post/" + fi.Name()
-		p := readPost(dir+"/post.txt", fi.Name())
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		p, err := readPost(dir+"/post/"+fi.Name()+"/post.txt", fi.Name())
+		if err != nil {
+			st.corrupt(err)
+			continue
+		}
+		st.readComments(dir, p)
 		sort.Slice(p.Comments, func(i, j int) bool {
 			return p.Comments[i].Time.After(p.Comments[j].Time)
 		})
-		posts = append(posts, p)
+		st.Posts = append(st.Posts, p)
 	}
-	sort.Slice(posts, func(i, j int) bool {
-		return posts[i].Time.After(posts[j].Time)
+	sort.Slice(st.Posts, func(i, j int) bool {
+		return st.Posts[i].Time.After(st.Posts[j].Time)
 	})
 
-	l, err = os.ReadDir("data/image")
+	st.readPages(dir)
+
+	l, err = os.ReadDir(dir + "/image")
 	if err != nil {
 		return nil, fmt.Errorf("listing images: %s", err)
 	}
 	for _, fi := range l {
-		dir := "data/image/" + fi.Name()
-		img := readImage(dir+"/image.txt", fi.Name())
-		images = append(images, img)
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		img, err := readImage(dir+"/image/"+fi.Name()+"/image.txt", fi.Name())
+		if err != nil {
+			st.corrupt(err)
+			continue
+		}
+		st.Images = append(st.Images, img)
 	}
-	sort.Slice(images, func(i, j int) bool {
-		return images[i].Time.After(images[j].Time)
+	sort.Slice(st.Images, func(i, j int) bool {
+		return st.Images[i].Time.After(st.Images[j].Time)
 	})
 
-	return &store{posts, images}, nil
+	st.Redirects, err = readRedirects(dir + "/redirects.txt")
+	if err != nil {
+		st.corrupt(err)
+	}
+
+	return st, nil
+}
+
+func (s *store) corrupt(err error) {
+	log.Printf("skipping corrupt file: %s", err)
+	s.Errors = append(s.Errors, err)
+}
+
+func (s *store) readComments(dir string, po *post) {
+	commentDir := fmt.Sprintf("%s/post/%s/comment", dir, po.ID)
+	l, err := os.ReadDir(commentDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.corrupt(fmt.Errorf("%s: listing comments: %s", commentDir, err))
+		}
+		return
+	}
+	for _, fi := range l {
+		if strings.HasPrefix(fi.Name(), ".") || !strings.HasSuffix(fi.Name(), ".txt") {
+			continue
+		}
+		commentID := strings.TrimSuffix(fi.Name(), ".txt")
+		c, err := readComment(commentDir+"/"+fi.Name(), po.ID, commentID)
+		if err != nil {
+			s.corrupt(err)
+			continue
+		}
+		po.Comments = append(po.Comments, c)
+	}
 }
 
 func (s *store) post(id string) *post {
@@ -110,6 +189,33 @@ func (s *store) post(id string) *post {
 	return nil // not reached
 }
 
+// Published returns whether the post is visible on the public pages at now.
+func (p *post) Published(now time.Time) bool {
+	return p.Active && (p.Publish.IsZero() || !now.Before(p.Publish)) && (p.Expire.IsZero() || now.Before(p.Expire))
+}
+
+// Scheduled returns whether the post is active but its publish time is in the future.
+func (p *post) Scheduled() bool {
+	return p.Active && !p.Publish.IsZero() && time.Now().Before(p.Publish)
+}
+
+// Expired returns whether the post is active but its expire time has passed.
+func (p *post) Expired() bool {
+	return p.Active && !p.Expire.IsZero() && !time.Now().Before(p.Expire)
+}
+
+// publishedPosts returns the posts that are visible on the public pages, newest first.
+func (s *store) publishedPosts() []*post {
+	now := time.Now()
+	posts := []*post{}
+	for _, p := range s.Posts {
+		if p.Published(now) {
+			posts = append(posts, p)
+		}
+	}
+	return posts
+}
+
 func (s *store) findPostBySlug(slug string) *post {
 	for _, p := range s.Posts {
 		if p.Slug == slug {
@@ -119,6 +225,18 @@ func (s *store) findPostBySlug(slug string) *post {
 	return nil
 }
 
+// findPostByOldSlug returns the post that used to have slug.
+func (s *store) findPostByOldSlug(slug string) *post {
+	for _, p := range s.Posts {
+		for _, old := range p.OldSlugs {
+			if old == slug {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
 func (s *store) comment(commentID string) (*post, *comment) {
 	for _, p := range s.Posts {
 		for _, c := range p.Comments {
@@ -144,17 +262,39 @@ func deletePost(p *post) error {
 	if p.ID == "" {
 		return errNoID
 	}
-	return os.RemoveAll(fmt.Sprintf("data/post/%s", p.ID))
+	if err := os.RemoveAll(fmt.Sprintf("data/post/%s", p.ID)); err != nil {
+		return err
+	}
+	return syncDir("data/post")
 }
 
 func deleteComment(c *comment) error {
-	return os.Remove(fmt.Sprintf("data/post/%s/comment/%s.txt", c.PostID, c.ID))
+	dir := fmt.Sprintf("data/post/%s/comment", c.PostID)
+	if err := os.Remove(fmt.Sprintf("%s/%s.txt", dir, c.ID)); err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
 
 type parseError struct{ error }
 
 type parser struct {
-	r *bufio.Reader
+	filename string
+	r        *bufio.Reader
+}
+
+// handle turns a parse error panic into an error mentioning the file.
+func (p *parser) handle(err *error) {
+	e := recover()
+	if e == nil {
+		return
+	}
+	ee, ok := e.(parseError)
+	if ok {
+		*err = fmt.Errorf("%s: %w", p.filename, ee.error)
+	} else {
+		panic(e)
+	}
 }
 
 func (p *parser) check(err error, action string) {
@@ -183,6 +323,17 @@ func (p *parser) Literal(s string) {
 	}
 }
 
+// Version reads the first line of a file, the format version.
+func (p *parser) Version() string {
+	text := p.readline()
+	switch text {
+	case "v1", "v2":
+		return text
+	}
+	p.errorf("got %q, expected version %q or %q", text, "v1", "v2")
+	return "" // not reached
+}
+
 func (p *parser) ID(id string) {
 	text := p.readline()
 	if id != text {
@@ -223,6 +374,40 @@ func (p *parser) Text(line string, v *string) {
 	*v = string(buf)
 }
 
+// Rest reads the remainder of the file, typically the body after a header.
+func (p *parser) Rest(v *string) {
+	buf, err := io.ReadAll(p.r)
+	p.check(err, "reading remaining text")
+	*v = string(buf)
+}
+
+// Header reads the "Key: value" lines of a v2 file. If withBody is set, the
+// header ends with a "body:" line, otherwise at the end of the file.
+func (p *parser) Header(withBody bool) *header {
+	h := &header{p: p, values: map[string][]string{}}
+	for {
+		if !withBody {
+			if _, err := p.r.Peek(1); err == io.EOF {
+				break
+			}
+		}
+		line := p.readline()
+		if withBody && line == "body:" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		v = strings.TrimPrefix(v, " ")
+		if !ok || k == "" {
+			p.errorf("got %q, expected header line %q", line, "Key: value")
+		}
+		if len(h.values[k]) == 0 {
+			h.keys = append(h.keys, k)
+		}
+		h.values[k] = append(h.values[k], v)
+	}
+	return h
+}
+
 func (p *parser) EOF() {
 	buf, err := io.ReadAll(p.r)
 	p.check(err, "reading for eof")
@@ -231,81 +416,234 @@ func (p *parser) EOF() {
 	}
 }
 
-func readPost(filename string, id string) (po *post) {
+func readPost(filename string, id string) (po *post, rerr error) {
 	po = &post{ID: id}
 
-	p := &parser{}
+	p := &parser{filename: filename}
+	defer p.handle(&rerr)
 	f, err := os.Open(filename)
 	p.check(err, "open post file")
 	defer f.Close()
 
 	p.r = bufio.NewReader(f)
 
-	p.Literal("v1")
-	p.ID(po.ID)
-	p.Bool(&po.Active, "inactive", "active")
-	p.Line(&po.Slug)
-	p.Line(&po.Title)
-	p.Time(&po.Time)
-	p.Text("body:", &po.Body)
-
-	commentDir := fmt.Sprintf("data/post/%s/comment", po.ID)
-	l, err := os.ReadDir(commentDir)
-	if err != nil && os.IsNotExist(err) {
-		return
-	}
-	p.check(err, "listing comments")
-	for _, fi := range l {
-		commentID := strings.TrimSuffix(fi.Name(), ".txt")
-		c := readComment(commentDir+"/"+fi.Name(), po.ID, commentID)
-		po.Comments = append(po.Comments, c)
+	switch p.Version() {
+	case "v1":
+		p.ID(po.ID)
+		p.Bool(&po.Active, "inactive", "active")
+		p.Line(&po.Slug)
+		p.Line(&po.Title)
+		p.Time(&po.Time)
+		p.Text("body:", &po.Body)
+		// Bodies were always executed as templates.
+		po.LegacyTemplates = strings.Contains(po.Body, "{{")
+	case "v2":
+		h := p.Header(true)
+		h.ID(po.ID)
+		h.Bool("Status", &po.Active, "inactive", "active")
+		h.Line("Slug", &po.Slug)
+		h.Lines("Old-Slug", &po.OldSlugs)
+		h.Line("Title", &po.Title)
+		h.Time("Time", &po.Time)
+		h.OptTime("Publish", &po.Publish)
+		h.OptTime("Expire", &po.Expire)
+		h.OptTime("Updated", &po.Updated)
+		h.OptLine("Author", &po.Author)
+		h.Tags("Tags", &po.Tags)
+		h.OptLine("Summary", &po.Summary)
+		h.OptInt("Page-Budget", &po.PageBudget)
+		h.Flag("Legacy-Templates", &po.LegacyTemplates)
+		h.Done()
+		p.Rest(&po.Body)
 	}
 
 	return
 }
 
-func readComment(filename string, postID, id string) (c *comment) {
+func readComment(filename string, postID, id string) (c *comment, rerr error) {
 	c = &comment{ID: id, PostID: postID}
 
-	p := &parser{}
+	p := &parser{filename: filename}
+	defer p.handle(&rerr)
 	f, err := os.Open(filename)
 	p.check(err, "open comment file")
 	defer f.Close()
 
 	p.r = bufio.NewReader(f)
 
-	p.Literal("v1")
-	p.ID(c.ID)
-	p.Bool(&c.Active, "inactive", "active")
-	p.Bool(&c.Seen, "notseen", "seen")
-	p.Time(&c.Time)
-	p.Line(&c.Author)
-	p.Text("body:", &c.Body)
+	switch p.Version() {
+	case "v1":
+		p.ID(c.ID)
+		p.Bool(&c.Active, "inactive", "active")
+		p.Bool(&c.Seen, "notseen", "seen")
+		p.Time(&c.Time)
+		p.Line(&c.Author)
+		p.Text("body:", &c.Body)
+	case "v2":
+		h := p.Header(true)
+		h.ID(c.ID)
+		h.Bool("Status", &c.Active, "inactive", "active")
+		h.Bool("Seen", &c.Seen, "no", "yes")
+		h.Time("Time", &c.Time)
+		h.Line("Author", &c.Author)
+		h.OptLine("Address", &c.Address)
+		h.OptLine("User-Agent", &c.UserAgent)
+		h.Done()
+		p.Rest(&c.Body)
+	}
 
 	return
 }
 
-func readImage(filename string, id string) (img *image) {
+func readImage(filename string, id string) (img *image, rerr error) {
 	img = &image{ID: id}
 
-	p := &parser{}
+	p := &parser{filename: filename}
+	defer p.handle(&rerr)
 	f, err := os.Open(filename)
 	p.check(err, "open image file")
 	defer f.Close()
 
 	p.r = bufio.NewReader(f)
 
-	p.Literal("v1")
-	p.ID(img.ID)
-	p.Line(&img.Slug)
-	p.Line(&img.Title)
-	p.Time(&img.Time)
-	p.Line(&img.Mimetype)
-	p.Line(&img.Filename)
-	p.EOF()
+	switch p.Version() {
+	case "v1":
+		p.ID(img.ID)
+		p.Line(&img.Slug)
+		p.Line(&img.Title)
+		p.Time(&img.Time)
+		p.Line(&img.Mimetype)
+		p.Line(&img.Filename)
+		p.EOF()
+	case "v2":
+		h := p.Header(false)
+		h.ID(img.ID)
+		h.Line("Slug", &img.Slug)
+		h.Line("Title", &img.Title)
+		h.OptLine("Alt", &img.Alt)
+		h.Time("Time", &img.Time)
+		h.Line("Mimetype", &img.Mimetype)
+		h.Line("Filename", &img.Filename)
+		h.OptTime("Captured", &img.Captured)
+		h.OptLine("Poster", &img.Poster)
+		h.Done()
+	}
 
-	_, err = os.Stat(fmt.Sprintf("data/image/%s/%s", img.ID, img.Filename))
+	_, err = os.Stat(filepath.Join(filepath.Dir(filename), img.Filename))
 	p.check(err, "checking existence of image data file")
+	if img.Poster != "" {
+		_, err = os.Stat(filepath.Join(filepath.Dir(filename), img.Poster))
+		p.check(err, "checking existence of poster file")
+	}
 
 	return
 }
+
+// header holds the "Key: value" lines of a v2 file. Each key must be consumed
+// by one of the methods, Done fails on unknown keys.
+type header struct {
+	p      *parser
+	keys   []string // In order of appearance.
+	values map[string][]string
+}
+
+// take returns the value for key and marks it as consumed.
+func (h *header) take(key string, required bool) (string, bool) {
+	l, ok := h.values[key]
+	if !ok {
+		if required {
+			h.p.errorf("missing header %q", key)
+		}
+		return "", false
+	}
+	if len(l) != 1 {
+		h.p.errorf("header %q present %d times, expected once", key, len(l))
+	}
+	delete(h.values, key)
+	return l[0], true
+}
+
+func (h *header) ID(id string) {
+	v, _ := h.take("ID", true)
+	if v != id {
+		h.p.errorf("got %q, expected id %q", v, id)
+	}
+}
+
+func (h *header) Line(key string, v *string) {
+	*v, _ = h.take(key, true)
+}
+
+func (h *header) OptLine(key string, v *string) {
+	*v, _ = h.take(key, false)
+}
+
+// Lines consumes all values of a key that may be repeated.
+func (h *header) Lines(key string, v *[]string) {
+	*v = h.values[key]
+	delete(h.values, key)
+}
+
+func (h *header) Bool(key string, v *bool, falseVal, trueVal string) {
+	s, _ := h.take(key, true)
+	switch s {
+	case falseVal:
+		*v = false
+	case trueVal:
+		*v = true
+	default:
+		h.p.errorf("header %q: got %q, expected boolean %q or %q", key, s, falseVal, trueVal)
+	}
+}
+
+// Flag parses an optional header that is only present with value "yes".
+func (h *header) Flag(key string, v *bool) {
+	if s, ok := h.take(key, false); ok {
+		if s != "yes" {
+			h.p.errorf("header %q: got %q, expected %q", key, s, "yes")
+		}
+		*v = true
+	}
+}
+
+func (h *header) parseTime(key, s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	h.p.check(err, fmt.Sprintf("header %q: parsing time", key))
+	return t
+}
+
+func (h *header) Time(key string, v *time.Time) {
+	s, _ := h.take(key, true)
+	*v = h.parseTime(key, s)
+}
+
+func (h *header) OptTime(key string, v *time.Time) {
+	if s, ok := h.take(key, false); ok {
+		*v = h.parseTime(key, s)
+	}
+}
+
+func (h *header) OptInt(key string, v *int) {
+	if s, ok := h.take(key, false); ok {
+		i, err := strconv.Atoi(s)
+		h.p.check(err, fmt.Sprintf("header %q: parsing number", key))
+		*v = i
+	}
+}
+
+// Tags parses a comma-separated list of tags.
+func (h *header) Tags(key string, v *[]string) {
+	s, _ := h.take(key, false)
+	tags, err := parseTags(s)
+	h.p.check(err, fmt.Sprintf("header %q", key))
+	*v = tags
+}
+
+// Done fails if the header contains keys that were not consumed.
+func (h *header) Done() {
+	for _, k := range h.keys {
+		if _, ok := h.values[k]; ok {
+			h.p.errorf("unknown header %q", k)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testDataDir changes to a new empty data directory with config for
+// https://example.org/, both restored when the test is done.
+func testDataDir(t *testing.T) {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedConfig, savedBaseURL := config, baseURL
+	t.Cleanup(func() {
+		storeChanged()
+		os.Chdir(dir)
+		config, baseURL = savedConfig, savedBaseURL
+	})
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"data/post", "data/page", "data/image", "data/www"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.BaseURL = "https://example.org/"
+	baseURL, err = url.Parse(config.BaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeChanged()
+}
+
+func TestReadPostVersions(t *testing.T) {
+	dir := t.TempDir()
+	tm := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	v1 := "v1\nabc\nactive\nslug\nTitle\n2024-01-02T15:04:05Z\nbody:\nsome\ntext\n"
+	path := filepath.Join(dir, "v1.txt")
+	if err := os.WriteFile(path, []byte(v1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPost(path, "abc")
+	if err != nil {
+		t.Fatalf("reading v1 post: %v", err)
+	}
+	xp := &post{ID: "abc", Active: true, Slug: "slug", Title: "Title", Time: tm, Body: "some\ntext\n"}
+	if !reflect.DeepEqual(p, xp) {
+		t.Fatalf("v1 post: got %#v, expected %#v", p, xp)
+	}
+
+	// Rewriting as v2 and reading again must give the same post.
+	xp.Updated = tm.Add(time.Hour)
+	xp.Author = "Someone"
+	buf, err := marshalPost(xp)
+	if err != nil {
+		t.Fatalf("marshal post: %v", err)
+	}
+	path = filepath.Join(dir, "v2.txt")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err = readPost(path, "abc")
+	if err != nil {
+		t.Fatalf("reading v2 post: %v", err)
+	}
+	if !reflect.DeepEqual(p, xp) {
+		t.Fatalf("v2 post: got %#v, expected %#v", p, xp)
+	}
+
+	bad := []string{
+		"v3\n",
+		"v2\nID: abc\nbody:\n",                   // Missing required headers.
+		"v2\nID: abc\nStatus: active\nbody:\n",   // Missing required headers.
+		"v2\nID: other\nStatus: active\nbody:\n", // Wrong ID.
+		"v2\nID: abc\nStatus: maybe\nbody:\n",    // Bad boolean.
+		"v2\nID: abc\nNonsense\nbody:\n",         // Not a header line.
+		"v2\nID: abc\nID: abc\nStatus: active\n", // Duplicate, no body.
+		"v2\nID: abc\nStatus: active\nSlug: s\nTitle: t\nTime: 2024-01-02T15:04:05Z\nColor: red\nbody:\n", // Unknown header.
+	}
+	for i, s := range bad {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPost(path, "abc"); err == nil {
+			t.Errorf("bad post %d: expected error", i+1)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+)
+
+type diffLine struct {
+	Op   string // "=" for unchanged, "-" for removed, "+" for added.
+	Text string
+}
+
+// lineDiff returns the lines of a and b, marked as unchanged, removed from a or
+// added in b. It uses a longest common subsequence, which is fine for the size
+// of blog posts.
+func lineDiff(a, b string) []diffLine {
+	al := splitLines(a)
+	bl := splitLines(b)
+
+	// lcs[i][j] is the length of the longest common subsequence of al[i:] and bl[j:].
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var r []diffLine
+	i, j := 0, 0
+	for i < len(al) && j < len(bl) {
+		switch {
+		case al[i] == bl[j]:
+			r = append(r, diffLine{"=", al[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			r = append(r, diffLine{"-", al[i]})
+			i++
+		default:
+			r = append(r, diffLine{"+", bl[j]})
+			j++
+		}
+	}
+	for ; i < len(al); i++ {
+		r = append(r, diffLine{"-", al[i]})
+	}
+	for ; j < len(bl); j++ {
+		r = append(r, diffLine{"+", bl[j]})
+	}
+	return r
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		out  string
+	}{
+		{"", "", ""},
+		{"a\n", "", "-a\n"},
+		{"", "a\n", "+a\n"},
+		{"a\nb\nc\n", "a\nb\nc", "=a\n=b\n=c\n"},
+		{"a\nb\nc\n", "a\nc\n", "=a\n-b\n=c\n"},
+		{"a\nc\n", "a\nb\nc\n", "=a\n+b\n=c\n"},
+		{"a\nb\n", "a\nx\n", "=a\n-b\n+x\n"},
+		{"a\r\nb\r\n", "a\nb\n", "=a\n=b\n"},
+	}
+	for i, tt := range tests {
+		var s string
+		for _, l := range lineDiff(tt.a, tt.b) {
+			s += l.Op + l.Text + "\n"
+		}
+		if s != tt.out {
+			t.Errorf("test %d: expected %q, saw %q", i+1, tt.out, s)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	imagelib "image"
+	"log"
+	"strings"
+	"time"
+)
+
+// Uploaded images are stored without metadata like GPS location and camera
+// details, unless requested otherwise. The EXIF orientation of JPEG files is
+// applied to the image itself, browsers and image.Decode do not all honor it.
+// The capture date is kept in image.txt.
+
+// exifInfo holds the EXIF fields we use.
+type exifInfo struct {
+	Orientation int       // 1-8, 0 if absent.
+	Captured    time.Time // From DateTimeOriginal, zero if absent.
+
+	// Location of the orientation value in the EXIF data, for resetting it.
+	orientationAt int
+	order         binary.ByteOrder
+}
+
+var errBadJPEG = errors.New("bad jpeg file")
+
+// jpegSegments calls fn for each marker segment of JPEG file data before the
+// image data, with the marker and the segment data including marker and length.
+// The offset of the remaining data, starting at the start of scan marker, is
+// returned.
+func jpegSegments(data []byte, fn func(marker byte, seg []byte)) (int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, errBadJPEG
+	}
+	o := 2
+	for {
+		if o+4 > len(data) || data[o] != 0xff {
+			return 0, errBadJPEG
+		}
+		marker := data[o+1]
+		if marker == 0xff {
+			// Fill byte.
+			o++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			// Start of scan or end of image.
+			return o, nil
+		}
+		n := int(binary.BigEndian.Uint16(data[o+2:]))
+		if n < 2 || o+2+n > len(data) {
+			return 0, errBadJPEG
+		}
+		fn(marker, data[o:o+2+n])
+		o += 2 + n
+	}
+}
+
+// jpegExif returns the EXIF fields from JPEG file data. Files without EXIF
+// result in a zero exifInfo.
+func jpegExif(data []byte) (info exifInfo, rerr error) {
+	var exif []byte
+	_, err := jpegSegments(data, func(marker byte, seg []byte) {
+		if marker == 0xe1 && exif == nil && isExifSegment(seg) {
+			exif = seg[10:]
+		}
+	})
+	if err != nil || exif == nil {
+		return info, err
+	}
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if ee, ok := e.(exifError); ok {
+			rerr = ee
+			return
+		}
+		panic(e)
+	}()
+	t := tiff{buf: exif}
+	switch string(t.bytes(0, 2)) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		t.errorf("bad byte order")
+	}
+	if t.uint16(2) != 42 {
+		t.errorf("bad tiff header")
+	}
+
+	var exifIFD uint32
+	var dateTime, offset string
+	t.ifd(t.uint32(4), func(tag, typ uint16, count uint32, value int) {
+		switch tag {
+		case 0x0112: // Orientation
+			if typ == 3 {
+				info.Orientation = int(t.uint16(value))
+				info.orientationAt = value
+				info.order = t.order
+			}
+		case 0x8769: // Exif IFD
+			exifIFD = t.uint32(value)
+		}
+	})
+	if exifIFD != 0 {
+		t.ifd(exifIFD, func(tag, typ uint16, count uint32, value int) {
+			switch tag {
+			case 0x9003: // DateTimeOriginal
+				dateTime = t.ascii(typ, count, value)
+			case 0x9011: // OffsetTimeOriginal
+				offset = t.ascii(typ, count, value)
+			}
+		})
+	}
+	if dateTime != "" {
+		// Without time zone offset, the local time zone is assumed.
+		var tm time.Time
+		var err error
+		if offset != "" {
+			tm, err = time.Parse("2006:01:02 15:04:05 -07:00", dateTime+" "+offset)
+		} else {
+			tm, err = time.ParseInLocation("2006:01:02 15:04:05", dateTime, time.Local)
+		}
+		if err == nil {
+			info.Captured = tm
+		}
+	}
+	if info.Orientation < 0 || info.Orientation > 8 {
+		info.Orientation = 0
+	}
+	return info, nil
+}
+
+type exifError struct{ error }
+
+// tiff reads the TIFF structure of EXIF data. Out of bounds reads panic with
+// an exifError.
+type tiff struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (t tiff) errorf(format string, args ...interface{}) {
+	panic(exifError{fmt.Errorf("exif: "+format, args...)})
+}
+
+func (t tiff) bytes(o, n int) []byte {
+	if o < 0 || n < 0 || o+n > len(t.buf) {
+		t.errorf("offset out of range")
+	}
+	return t.buf[o : o+n]
+}
+
+func (t tiff) uint16(o int) uint16 {
+	return t.order.Uint16(t.bytes(o, 2))
+}
+
+func (t tiff) uint32(o int) uint32 {
+	return t.order.Uint32(t.bytes(o, 4))
+}
+
+// ifd calls fn for each entry of the IFD at offset o, with the offset of the
+// value field of the entry.
+func (t tiff) ifd(o uint32, fn func(tag, typ uint16, count uint32, value int)) {
+	if o > uint32(len(t.buf)) {
+		t.errorf("ifd offset out of range")
+	}
+	n := int(t.uint16(int(o)))
+	for i := 0; i < n; i++ {
+		e := int(o) + 2 + 12*i
+		fn(t.uint16(e), t.uint16(e+2), t.uint32(e+4), e+8)
+	}
+}
+
+// ascii returns the string of an ASCII entry with its value field at offset value.
+func (t tiff) ascii(typ uint16, count uint32, value int) string {
+	if typ != 2 || count > 64 {
+		return ""
+	}
+	var buf []byte
+	if count <= 4 {
+		buf = t.bytes(value, int(count))
+	} else {
+		buf = t.bytes(int(t.uint32(value)), int(count))
+	}
+	return strings.TrimRight(string(buf), "\x00 ")
+}
+
+func isExifSegment(seg []byte) bool {
+	return bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00"))
+}
+
+// jpegMetadata returns the segments of JPEG file data that stripJPEGMetadata
+// removes, with the EXIF orientation from info set to 1, for an image that has
+// been turned upright.
+func jpegMetadata(data []byte, info exifInfo) []byte {
+	var buf bytes.Buffer
+	var exifSeen bool
+	jpegSegments(data, func(marker byte, seg []byte) {
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			return
+		}
+		if marker == 0xe1 && !exifSeen && isExifSegment(seg) {
+			exifSeen = true
+			if info.order != nil {
+				seg = append([]byte{}, seg...)
+				info.order.PutUint16(seg[10+info.orientationAt:], 1)
+			}
+		}
+		buf.Write(seg)
+	})
+	return buf.Bytes()
+}
+
+// stripJPEGMetadata returns JPEG file data without EXIF and XMP (APP1), IPTC
+// (APP13) and comment segments. The image data is not changed.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(data[:min(2, len(data))])
+	o, err := jpegSegments(data, func(marker byte, seg []byte) {
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			buf.Write(seg)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(data[o:])
+	return buf.Bytes(), nil
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripPNGMetadata returns PNG file data without EXIF and text chunks.
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("bad png file")
+	}
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	o := len(pngSignature)
+	for o < len(data) {
+		if o+12 > len(data) {
+			return nil, errors.New("bad png chunk")
+		}
+		n := int(binary.BigEndian.Uint32(data[o:]))
+		if n < 0 || o+12+n > len(data) {
+			return nil, errors.New("bad png chunk length")
+		}
+		switch string(data[o+4 : o+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			buf.Write(data[o : o+12+n])
+		}
+		o += 12 + n
+	}
+	return buf.Bytes(), nil
+}
+
+// orient returns m transformed so an image with EXIF orientation o is upright.
+func orient(m imagelib.Image, o int) imagelib.Image {
+	if o <= 1 || o > 8 {
+		return m
+	}
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var n *imagelib.NRGBA
+	if o >= 5 {
+		n = imagelib.NewNRGBA(imagelib.Rect(0, 0, h, w))
+	} else {
+		n = imagelib.NewNRGBA(imagelib.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // Mirrored.
+				dx, dy = w-1-x, y
+			case 3: // Upside down.
+				dx, dy = w-1-x, h-1-y
+			case 4: // Upside down, mirrored.
+				dx, dy = x, h-1-y
+			case 5: // Mirrored, rotated.
+				dx, dy = y, x
+			case 6: // Needs rotation clockwise.
+				dx, dy = h-1-y, x
+			case 7: // Mirrored, rotated the other way.
+				dx, dy = h-1-y, w-1-x
+			case 8: // Needs rotation counterclockwise.
+				dx, dy = y, w-1-x
+			}
+			n.Set(dx, dy, m.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return n
+}
+
+// processUpload returns the data of an uploaded image to store, with its
+// orientation applied and metadata removed unless keepMetadata is set, and the
+// time the image was captured, if known.
+func processUpload(mimetype string, data []byte, keepMetadata bool) ([]byte, time.Time, error) {
+	switch mimetype {
+	case "image/jpeg":
+		info, err := jpegExif(data)
+		if err != nil {
+			// Not fatal, the image may still be usable.
+			log.Printf("parsing exif data of uploaded image: %v", err)
+		}
+		if info.Orientation > 1 {
+			m, _, err := imagelib.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("decoding image: %v", err)
+			}
+			// Encoding drops all metadata, including the orientation that no
+			// longer applies. Metadata to keep is put back, upright.
+			buf := encodeImage(orient(m, info.Orientation), "jpeg", 90)
+			if keepMetadata {
+				buf = append(append(buf[:2:2], jpegMetadata(data, info)...), buf[2:]...)
+			}
+			return buf, info.Captured, nil
+		}
+		if !keepMetadata {
+			data, err = stripJPEGMetadata(data)
+		}
+		return data, info.Captured, err
+	case "image/png":
+		if keepMetadata {
+			return data, time.Time{}, nil
+		}
+		data, err := stripPNGMetadata(data)
+		return data, time.Time{}, err
+	}
+	return data, time.Time{}, nil
+}
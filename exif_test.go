@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	imagelib "image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// exifSegment returns an APP1 segment with big-endian EXIF data holding
+// orientation and DateTimeOriginal.
+func exifSegment(orientation uint16, dateTime string) []byte {
+	var t bytes.Buffer
+	w := func(v interface{}) { binary.Write(&t, binary.BigEndian, v) }
+	t.WriteString("MM")
+	w(uint16(42))
+	w(uint32(8))
+	// IFD0 at 8: orientation and pointer to exif IFD.
+	w(uint16(2))
+	w([]uint16{0x0112, 3})
+	w(uint32(1))
+	w([]uint16{orientation, 0})
+	w([]uint16{0x8769, 4})
+	w(uint32(1))
+	w(uint32(8 + 2 + 2*12 + 4))
+	w(uint32(0))
+	// Exif IFD, with the date right after it.
+	date := append([]byte(dateTime), 0)
+	w(uint16(1))
+	w([]uint16{0x9003, 2})
+	w(uint32(len(date)))
+	w(uint32(t.Len() + 4 + 4))
+	w(uint32(0))
+	t.Write(date)
+
+	seg := []byte{0xff, 0xe1, 0, 0}
+	seg = append(seg, "Exif\x00\x00"...)
+	seg = append(seg, t.Bytes()...)
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)-2))
+	return seg
+}
+
+func TestUploadMetadata(t *testing.T) {
+	// 32x16 image, left half red, right half white.
+	m := imagelib.NewNRGBA(imagelib.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.NRGBA{255, 255, 255, 255}
+			if x < 16 {
+				c = color.NRGBA{255, 0, 0, 255}
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	var jbuf bytes.Buffer
+	if err := jpeg.Encode(&jbuf, m, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	withExif := func(orientation uint16) []byte {
+		return append(append([]byte{0xff, 0xd8}, exifSegment(orientation, "2020:05:06 07:08:09")...), jbuf.Bytes()[2:]...)
+	}
+
+	info, err := jpegExif(withExif(6))
+	if err != nil {
+		t.Fatalf("jpegExif: %v", err)
+	}
+	captured := time.Date(2020, 5, 6, 7, 8, 9, 0, time.Local)
+	if info.Orientation != 6 || !info.Captured.Equal(captured) {
+		t.Fatalf("jpegExif: got %+v, expected orientation 6 and captured %v", info, captured)
+	}
+	if info, err := jpegExif(jbuf.Bytes()); err != nil || info != (exifInfo{}) {
+		t.Fatalf("jpegExif without exif: got %+v, %v", info, err)
+	}
+	// Bad offsets in exif data result in an error, not a panic.
+	bad := withExif(1)
+	binary.BigEndian.PutUint32(bad[2+4+6+4:], 1000)
+	if _, err := jpegExif(bad); err == nil {
+		t.Fatalf("jpegExif with bad ifd offset: expected error")
+	}
+
+	// Orientation 1: the image data is kept, the exif segment removed.
+	buf, tm, err := processUpload("image/jpeg", withExif(1), false)
+	if err != nil || !tm.Equal(captured) {
+		t.Fatalf("processUpload: %v, captured %v", err, tm)
+	}
+	if !bytes.Equal(buf, jbuf.Bytes()) {
+		t.Fatalf("processUpload: metadata not stripped")
+	}
+	buf, _, _ = processUpload("image/jpeg", withExif(1), true)
+	if !bytes.Equal(buf, withExif(1)) {
+		t.Fatalf("processUpload with keepMetadata: data changed")
+	}
+
+	// Orientation 6: rotated clockwise, red ends up at the top.
+	buf, _, err = processUpload("image/jpeg", withExif(6), false)
+	if err != nil {
+		t.Fatalf("processUpload: %v", err)
+	}
+	if bytes.Contains(buf, []byte("Exif\x00\x00")) {
+		t.Fatalf("processUpload: exif still present after orienting")
+	}
+	// With keepMetadata, the exif data is kept, but the image is now upright.
+	buf, _, err = processUpload("image/jpeg", withExif(6), true)
+	if err != nil {
+		t.Fatalf("processUpload: %v", err)
+	}
+	if info, err := jpegExif(buf); err != nil || info.Orientation != 1 || !info.Captured.Equal(captured) {
+		t.Fatalf("processUpload with keepMetadata: got %+v, %v, expected orientation 1 and captured %v", info, err, captured)
+	}
+	r, err := jpeg.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := r.Bounds(); b.Dx() != 16 || b.Dy() != 32 {
+		t.Fatalf("processUpload: size %v, expected 16x32", b)
+	}
+	if c := color.NRGBAModel.Convert(r.At(8, 4)).(color.NRGBA); c.R < 200 || c.G > 50 {
+		t.Fatalf("processUpload: top %v, expected red", c)
+	}
+	if c := color.NRGBAModel.Convert(r.At(8, 28)).(color.NRGBA); c.G < 200 {
+		t.Fatalf("processUpload: bottom %v, expected white", c)
+	}
+
+	var pbuf bytes.Buffer
+	if err := png.Encode(&pbuf, m); err != nil {
+		t.Fatal(err)
+	}
+	// Insert a tEXt chunk after IHDR, which is 8+25 bytes into the file.
+	text := []byte("\x00\x00\x00\x07tEXtGPS\x00x,y\x00\x00\x00\x00")
+	withText := append(append(append([]byte{}, pbuf.Bytes()[:33]...), text...), pbuf.Bytes()[33:]...)
+	buf, _, err = processUpload("image/png", withText, false)
+	if err != nil || !bytes.Equal(buf, pbuf.Bytes()) {
+		t.Fatalf("processUpload png: %v, text chunk not stripped", err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1 image, red then blue. For each orientation, the position of red
+	// after making the image upright.
+	m := imagelib.NewNRGBA(imagelib.Rect(0, 0, 2, 1))
+	red := color.NRGBA{255, 0, 0, 255}
+	m.SetNRGBA(0, 0, red)
+	m.SetNRGBA(1, 0, color.NRGBA{0, 0, 255, 255})
+	tests := []struct {
+		o    int
+		x, y int
+	}{
+		{1, 0, 0},
+		{2, 1, 0},
+		{3, 1, 0},
+		{4, 0, 0},
+		{5, 0, 0},
+		{6, 0, 0},
+		{7, 0, 1},
+		{8, 0, 1},
+	}
+	for _, tc := range tests {
+		r := orient(m, tc.o)
+		if tc.o >= 5 && r.Bounds().Dx() != 1 {
+			t.Fatalf("orientation %d: size %v, expected 1x2", tc.o, r.Bounds())
+		}
+		if c := color.NRGBAModel.Convert(r.At(tc.x, tc.y)).(color.NRGBA); c != red {
+			t.Fatalf("orientation %d: %d,%d is %v, expected red", tc.o, tc.x, tc.y, c)
+		}
+	}
+}
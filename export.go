@@ -0,0 +1,529 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// An export archive is a gzipped tar file with:
+//
+//	blog.json                   all posts, comments, pages, images and redirects, see exportBlog
+//	images/<imageid>/<filename> image data files
+//	posts/<slug>.md             posts as markdown with front matter, for other tools
+//	pages/<slug>.md             pages as markdown with front matter
+//
+// Import only uses blog.json and the image data files.
+
+// exportBlog is the layout of blog.json. Field names are stable, new fields
+// may be added.
+type exportBlog struct {
+	Version   int // Currently 1.
+	Exported  time.Time
+	Posts     []exportPost
+	Pages     []exportPage
+	Images    []exportImage
+	Redirects []exportRedirect
+}
+
+type exportPost struct {
+	ID              string
+	Active          bool
+	Slug            string
+	OldSlugs        []string
+	Title           string
+	Time            time.Time
+	Publish         *time.Time `json:",omitempty"`
+	Expire          *time.Time `json:",omitempty"`
+	Updated         *time.Time `json:",omitempty"`
+	Author          string
+	Tags            []string
+	Summary         string
+	PageBudget      int  `json:",omitempty"`
+	LegacyTemplates bool `json:",omitempty"`
+	Body            string
+	Comments        []exportComment
+}
+
+type exportComment struct {
+	ID        string
+	Active    bool
+	Seen      bool
+	Time      time.Time
+	Author    string
+	Address   string
+	UserAgent string
+	Body      string
+}
+
+type exportPage struct {
+	ID              string
+	Active          bool
+	Slug            string
+	Title           string
+	Time            time.Time
+	Updated         *time.Time `json:",omitempty"`
+	Menu            int
+	LegacyTemplates bool `json:",omitempty"`
+	Body            string
+}
+
+type exportImage struct {
+	ID         string
+	Slug       string
+	Title      string
+	Alt        string
+	Time       time.Time
+	Mimetype   string
+	Filename   string
+	Captured   *time.Time `json:",omitempty"`
+	Path       string     // Path of the data file in the archive.
+	Poster     string     `json:",omitempty"`
+	PosterPath string     `json:",omitempty"` // Path of the poster file in the archive.
+}
+
+type exportRedirect struct {
+	From string
+	To   string
+}
+
+func optTime(tm time.Time) *time.Time {
+	if tm.IsZero() {
+		return nil
+	}
+	return &tm
+}
+
+func fromOptTime(tm *time.Time) time.Time {
+	if tm == nil {
+		return time.Time{}
+	}
+	return *tm
+}
+
+func exportArchive(args []string) {
+	fl := flag.NewFlagSet("export", flag.ExitOnError)
+	fl.Usage = func() {
+		log.Printf("usage: blogx export blog.tar.gz")
+		log.Printf("Writes all posts, comments, pages, images and redirects in the data directory in the current directory to an archive.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	args = fl.Args()
+	if len(args) != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	data, err := readStore()
+	check(err, "reading store")
+	if len(data.Errors) > 0 {
+		log.Fatalf("data directory has corrupt files, not exporting")
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	check(err, "creating archive")
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+
+	now := time.Now()
+	add := func(name string, buf []byte) {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(buf)), ModTime: now})
+		check(err, "writing tar header")
+		_, err = tw.Write(buf)
+		check(err, "writing tar data")
+	}
+
+	blog := exportBlog{Version: 1, Exported: now}
+	for _, p := range data.Posts {
+		xp := exportPost{
+			ID:              p.ID,
+			Active:          p.Active,
+			Slug:            p.Slug,
+			OldSlugs:        p.OldSlugs,
+			Title:           p.Title,
+			Time:            p.Time,
+			Publish:         optTime(p.Publish),
+			Expire:          optTime(p.Expire),
+			Updated:         optTime(p.Updated),
+			Author:          p.Author,
+			Tags:            p.Tags,
+			Summary:         p.Summary,
+			PageBudget:      p.PageBudget,
+			LegacyTemplates: p.LegacyTemplates,
+			Body:            p.Body,
+		}
+		for _, c := range p.Comments {
+			xp.Comments = append(xp.Comments, exportComment{c.ID, c.Active, c.Seen, c.Time, c.Author, c.Address, c.UserAgent, c.Body})
+		}
+		blog.Posts = append(blog.Posts, xp)
+	}
+	for _, pg := range data.Pages {
+		blog.Pages = append(blog.Pages, exportPage{pg.ID, pg.Active, pg.Slug, pg.Title, pg.Time, optTime(pg.Updated), pg.Menu, pg.LegacyTemplates, pg.Body})
+	}
+	for _, img := range data.Images {
+		xi := exportImage{img.ID, img.Slug, img.Title, img.Alt, img.Time, img.Mimetype, img.Filename, optTime(img.Captured), fmt.Sprintf("images/%s/%s", img.ID, img.Filename), img.Poster, ""}
+		if img.Poster != "" {
+			xi.PosterPath = fmt.Sprintf("images/%s/%s", img.ID, img.Poster)
+		}
+		blog.Images = append(blog.Images, xi)
+	}
+	for _, rd := range data.Redirects {
+		blog.Redirects = append(blog.Redirects, exportRedirect{rd.From, rd.To})
+	}
+
+	buf, err := json.MarshalIndent(blog, "", "\t")
+	check(err, "marshal blog.json")
+	add("blog.json", append(buf, '\n'))
+
+	for _, img := range data.Images {
+		buf, err := img.Data()
+		check(err, "reading image data")
+		add(fmt.Sprintf("images/%s/%s", img.ID, img.Filename), buf)
+		if img.Poster != "" {
+			buf, err := img.PosterData()
+			check(err, "reading poster data")
+			add(fmt.Sprintf("images/%s/%s", img.ID, img.Poster), buf)
+		}
+	}
+	for _, p := range data.Posts {
+		add(fmt.Sprintf("posts/%s.md", p.Slug), frontMatterPost(p))
+	}
+	for _, pg := range data.Pages {
+		add(fmt.Sprintf("pages/%s.md", pg.Slug), frontMatterPage(pg))
+	}
+
+	check(tw.Close(), "closing tar")
+	check(gzw.Close(), "closing gzip")
+	check(f.Close(), "closing archive")
+	log.Printf("exported %d posts, %d pages and %d images to %s", len(data.Posts), len(data.Pages), len(data.Images), args[0])
+}
+
+// frontMatterPost returns the post as markdown with yaml front matter, as used
+// by static site generators like Hugo and Jekyll. Strings are written as json,
+// which is valid yaml.
+func frontMatterPost(p *post) []byte {
+	q := func(v interface{}) string {
+		buf, err := json.Marshal(v)
+		check(err, "marshal front matter")
+		return string(buf)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "---\n")
+	fmt.Fprintf(&b, "title: %s\n", q(p.Title))
+	fmt.Fprintf(&b, "date: %s\n", p.Time.Format(time.RFC3339))
+	if !p.Updated.IsZero() {
+		fmt.Fprintf(&b, "lastmod: %s\n", p.Updated.Format(time.RFC3339))
+	}
+	if !p.Publish.IsZero() {
+		fmt.Fprintf(&b, "publishDate: %s\n", p.Publish.Format(time.RFC3339))
+	}
+	if !p.Expire.IsZero() {
+		fmt.Fprintf(&b, "expiryDate: %s\n", p.Expire.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "slug: %s\n", q(p.Slug))
+	fmt.Fprintf(&b, "draft: %v\n", !p.Active)
+	if p.Author != "" {
+		fmt.Fprintf(&b, "author: %s\n", q(p.Author))
+	}
+	if len(p.Tags) > 0 {
+		fmt.Fprintf(&b, "tags: %s\n", q(p.Tags))
+	}
+	if p.Summary != "" {
+		fmt.Fprintf(&b, "summary: %s\n", q(p.Summary))
+	}
+	if len(p.OldSlugs) > 0 {
+		var aliases []string
+		for _, s := range p.OldSlugs {
+			aliases = append(aliases, "/p/"+s+"/")
+		}
+		fmt.Fprintf(&b, "aliases: %s\n", q(aliases))
+	}
+	fmt.Fprintf(&b, "---\n")
+	b.WriteString(p.Body)
+	return b.Bytes()
+}
+
+// frontMatterPage returns the page as markdown with front matter, like frontMatterPost.
+func frontMatterPage(pg *page) []byte {
+	q := func(v interface{}) string {
+		buf, err := json.Marshal(v)
+		check(err, "marshal front matter")
+		return string(buf)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "---\n")
+	fmt.Fprintf(&b, "title: %s\n", q(pg.Title))
+	fmt.Fprintf(&b, "date: %s\n", pg.Time.Format(time.RFC3339))
+	if !pg.Updated.IsZero() {
+		fmt.Fprintf(&b, "lastmod: %s\n", pg.Updated.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "slug: %s\n", q(pg.Slug))
+	fmt.Fprintf(&b, "draft: %v\n", !pg.Active)
+	if pg.Menu != 0 {
+		fmt.Fprintf(&b, "menu:\n  main:\n    weight: %d\n", pg.Menu)
+	}
+	fmt.Fprintf(&b, "---\n")
+	b.WriteString(pg.Body)
+	return b.Bytes()
+}
+
+func importArchive(args []string) {
+	fl := flag.NewFlagSet("import", flag.ExitOnError)
+	dryrun := fl.Bool("dryrun", false, "Only report what would be imported and any collisions")
+	skip := fl.Bool("skip", false, "Skip posts, pages, images and redirects that collide with existing ones instead of failing")
+	fl.Usage = func() {
+		log.Printf("usage: blogx import [-dryrun] [-skip] blog.tar.gz")
+		log.Printf("Adds the contents of an archive created with export to the data directory in the current directory. Stop blogx serve first.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	args = fl.Args()
+	if len(args) != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	blog, files, err := readArchive(args[0])
+	check(err, "reading archive")
+	if blog.Version != 1 {
+		log.Fatalf("unsupported archive version %d", blog.Version)
+	}
+
+	for _, dir := range []string{"data/post", "data/image", "data/www"} {
+		check(ensureDir(dir), "creating data directory")
+	}
+	data, err := readStore()
+	check(err, "reading store")
+
+	// Find collisions with existing data, and with earlier entries in the archive.
+	postIDs := map[string]bool{}
+	slugs := map[string]bool{}
+	for _, p := range data.Posts {
+		postIDs[p.ID] = true
+		slugs[p.Slug] = true
+		for _, s := range p.OldSlugs {
+			slugs[s] = true
+		}
+	}
+	pageIDs := map[string]bool{}
+	pageSlugs := map[string]bool{}
+	for _, pg := range data.Pages {
+		pageIDs[pg.ID] = true
+		pageSlugs[pg.Slug] = true
+	}
+	imageIDs := map[string]bool{}
+	imageSlugs := map[string]bool{}
+	for _, img := range data.Images {
+		imageIDs[img.ID] = true
+		imageSlugs[img.Slug] = true
+	}
+	redirects := map[string]bool{}
+	for _, rd := range data.Redirects {
+		redirects[rd.From] = true
+	}
+
+	var collisions int
+	collision := func(format string, args ...interface{}) {
+		log.Printf("collision: "+format, args...)
+		collisions++
+	}
+
+	var posts []*post
+	for _, xp := range blog.Posts {
+		if !safeName(xp.ID) || !safeName(xp.Slug) {
+			log.Fatalf("post with invalid id %q or slug %q", xp.ID, xp.Slug)
+		}
+		if postIDs[xp.ID] {
+			collision("post id %s (%s) already exists", xp.ID, xp.Slug)
+			continue
+		}
+		if slugs[xp.Slug] {
+			collision("post slug %s (id %s) already exists", xp.Slug, xp.ID)
+			continue
+		}
+		postIDs[xp.ID] = true
+		slugs[xp.Slug] = true
+		tags, err := parseTags(strings.Join(xp.Tags, ","))
+		check(err, fmt.Sprintf("post %s", xp.ID))
+		p := &post{
+			ID:              xp.ID,
+			Active:          xp.Active,
+			Slug:            xp.Slug,
+			OldSlugs:        xp.OldSlugs,
+			Title:           xp.Title,
+			Time:            xp.Time,
+			Publish:         fromOptTime(xp.Publish),
+			Expire:          fromOptTime(xp.Expire),
+			Updated:         fromOptTime(xp.Updated),
+			Author:          xp.Author,
+			Tags:            tags,
+			Summary:         xp.Summary,
+			PageBudget:      xp.PageBudget,
+			LegacyTemplates: xp.LegacyTemplates,
+			Body:            xp.Body,
+		}
+		for _, xc := range xp.Comments {
+			if !safeName(xc.ID) {
+				log.Fatalf("comment with invalid id %q", xc.ID)
+			}
+			p.Comments = append(p.Comments, &comment{xc.ID, p.ID, xc.Active, xc.Seen, xc.Time, xc.Author, xc.Address, xc.UserAgent, xc.Body})
+		}
+		posts = append(posts, p)
+	}
+
+	var pages []*page
+	for _, xpg := range blog.Pages {
+		if !safeName(xpg.ID) || checkPageSlug(xpg.Slug) != nil {
+			log.Fatalf("page with invalid id %q or slug %q", xpg.ID, xpg.Slug)
+		}
+		if pageIDs[xpg.ID] {
+			collision("page id %s (%s) already exists", xpg.ID, xpg.Slug)
+			continue
+		}
+		if pageSlugs[xpg.Slug] {
+			collision("page slug %s (id %s) already exists", xpg.Slug, xpg.ID)
+			continue
+		}
+		pageIDs[xpg.ID] = true
+		pageSlugs[xpg.Slug] = true
+		pages = append(pages, &page{xpg.ID, xpg.Active, xpg.Slug, xpg.Title, xpg.Time, fromOptTime(xpg.Updated), xpg.Menu, xpg.LegacyTemplates, xpg.Body})
+	}
+
+	var images []*image
+	for _, xi := range blog.Images {
+		if !safeName(xi.ID) || !safeName(xi.Filename) || xi.Filename == "image.txt" {
+			log.Fatalf("image with invalid id %q or filename %q", xi.ID, xi.Filename)
+		}
+		if _, ok := files[xi.Path]; !ok {
+			log.Fatalf("image %s: data file %q missing in archive", xi.ID, xi.Path)
+		}
+		if xi.Poster != "" {
+			if !safeName(xi.Poster) || xi.Poster == "image.txt" || xi.Poster == xi.Filename {
+				log.Fatalf("image %s: invalid poster filename %q", xi.ID, xi.Poster)
+			}
+			if _, ok := files[xi.PosterPath]; !ok {
+				log.Fatalf("image %s: poster file %q missing in archive", xi.ID, xi.PosterPath)
+			}
+		}
+		if imageIDs[xi.ID] {
+			collision("image id %s (%s) already exists", xi.ID, xi.Slug)
+			continue
+		}
+		if imageSlugs[xi.Slug] {
+			collision("image slug %s (id %s) already exists", xi.Slug, xi.ID)
+			continue
+		}
+		imageIDs[xi.ID] = true
+		imageSlugs[xi.Slug] = true
+		images = append(images, &image{xi.ID, xi.Time, xi.Slug, xi.Title, xi.Alt, xi.Filename, xi.Mimetype, fromOptTime(xi.Captured), xi.Poster})
+	}
+
+	newRedirects := data.Redirects
+	nredirects := 0
+	for _, xr := range blog.Redirects {
+		if err := checkRedirect(xr.From, xr.To); err != nil {
+			log.Fatalf("redirect from %q to %q: %v", xr.From, xr.To, err)
+		}
+		if redirects[xr.From] {
+			collision("redirect from %s already exists", xr.From)
+			continue
+		}
+		redirects[xr.From] = true
+		newRedirects = append(newRedirects, &redirect{xr.From, xr.To})
+		nredirects++
+	}
+
+	if collisions > 0 && !*skip {
+		log.Fatalf("%d collisions, nothing imported, use -skip to import everything else", collisions)
+	}
+	if *dryrun {
+		log.Printf("would import %d posts, %d pages, %d images and %d redirects, skipping %d", len(posts), len(pages), len(images), nredirects, collisions)
+		return
+	}
+
+	for _, p := range posts {
+		check(writePost(p), "writing post")
+		for _, c := range p.Comments {
+			check(writeComment(c), "writing comment")
+		}
+	}
+	for _, pg := range pages {
+		check(writePage(pg), "writing page")
+	}
+	for _, img := range images {
+		var path, posterPath string
+		for _, xi := range blog.Images {
+			if xi.ID == img.ID {
+				path = xi.Path
+				posterPath = xi.PosterPath
+			}
+		}
+		check(writeImageData(img, files[path]), "writing image data")
+		if img.Poster != "" {
+			check(writePosterData(img, files[posterPath]), "writing poster data")
+		}
+		check(writeImage(img), "writing image")
+	}
+	if nredirects > 0 {
+		check(writeRedirects(newRedirects), "writing redirects")
+	}
+	removeAllWritethrough()
+	log.Printf("imported %d posts, %d pages, %d images and %d redirects, skipped %d", len(posts), len(pages), len(images), nredirects, collisions)
+}
+
+// readArchive reads blog.json and all image files from an export archive.
+func readArchive(filename string) (*exportBlog, map[string][]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(gzr)
+	var blog *exportBlog
+	files := map[string][]byte{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		name := path.Clean(h.Name)
+		switch {
+		case name == "blog.json":
+			blog = &exportBlog{}
+			if err := json.NewDecoder(tr).Decode(blog); err != nil {
+				return nil, nil, fmt.Errorf("parsing blog.json: %v", err)
+			}
+		case strings.HasPrefix(name, "images/"):
+			buf, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			files[name] = buf
+		}
+	}
+	if blog == nil {
+		return nil, nil, fmt.Errorf("no blog.json in archive")
+	}
+	return blog, files, nil
+}
+
+// safeName returns whether s can be used as a single file name in the data directory.
+func safeName(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.HasPrefix(s, ".") && !strings.ContainsAny(s, "/\\\x00")
+}
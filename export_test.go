@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	testDataDir(t)
+
+	tm := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	p := &post{ID: "post1", Active: true, Slug: "hello", OldSlugs: []string{"hi"}, Title: "Hello", Time: tm, Publish: tm.Add(time.Hour), Tags: []string{"go"}, Summary: "Short.", Body: "Some *text*.\n"}
+	p.Comments = []*comment{{ID: "comment1", PostID: p.ID, Active: true, Time: tm, Author: "Someone", Body: "Nice.\n"}}
+	pg := &page{ID: "page1", Active: true, Slug: "about", Title: "About", Time: tm, Menu: 1, Body: "About me.\n"}
+	img := &image{ID: "image1", Time: tm, Slug: "cat", Title: "Cat", Filename: "data.png", Mimetype: "image/png"}
+	for _, err := range []error{
+		writePost(p),
+		writeComment(p.Comments[0]),
+		writePage(pg),
+		writeImageData(img, []byte("not really a png")),
+		writeImage(img),
+		writeRedirects([]*redirect{{"old/page?id=1", "about/"}, {"feed", "https://example.com/feed"}}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported, err := readStore()
+	if err != nil || len(exported.Posts) != 1 || len(exported.Pages) != 1 || len(exported.Images) != 1 || len(exported.Redirects) != 2 {
+		t.Fatalf("reading store: %v, %#v", err, exported)
+	}
+
+	archive := filepath.Join(t.TempDir(), "blog.tar.gz")
+	exportArchive([]string{archive})
+
+	testDataDir(t)
+	importArchive([]string{archive})
+	imported, err := readStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported, exported) {
+		t.Fatalf("import after export:\ngot      %#v\nexpected %#v", imported, exported)
+	}
+	if buf, err := imported.Images[0].Data(); err != nil || string(buf) != "not really a png" {
+		t.Fatalf("image data after import: got %q, %v", buf, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"golang.org/x/tools/blog/atom"
@@ -13,29 +14,29 @@ import (
 func atomFeed(w http.ResponseWriter, r *http.Request) {
 	needGet(r)
 
-	data, err := readStore()
+	data, err := loadStore()
 	httpCheck(err)
 
-	posts := []*post{}
-	for _, p := range data.Posts {
-		if p.Active {
-			posts = append(posts, p)
-		}
-	}
+	serveFeed(w, data.publishedPosts(), config.BlogTitle, config.BaseURL, "data/www/feed.atom")
+}
 
+// serveFeed writes an atom feed with posts to the response, and caches it at
+// cachePath in data/www.
+func serveFeed(w http.ResponseWriter, posts []*post, title, link, cachePath string) {
 	var updated time.Time
 	if len(posts) > 0 {
 		updated = posts[0].Time
 	}
 	feed := atom.Feed{
-		Title:   config.BlogTitle,
-		ID:      config.BaseURL,
-		Link:    []atom.Link{{Href: config.BaseURL}},
+		Title:   title,
+		ID:      link,
+		Link:    []atom.Link{{Href: link}},
 		Updated: atom.Time(updated),
 		Author:  &atom.Person{Name: config.BlogAuthor},
 	}
+	budget := newImageBudget(config.PageBudget)
 	for _, p := range posts {
-		html, err := renderShortMarkdown(p.Body)
+		html, err := renderSummary(p, budget)
 		httpCheck(err)
 
 		href := config.BaseURL + "p/" + p.Slug + "/"
@@ -44,6 +45,7 @@ func atomFeed(w http.ResponseWriter, r *http.Request) {
 			Link:    []atom.Link{{Href: href}},
 			ID:      href,
 			Updated: atom.Time(p.Time),
+			Author:  postAuthor(p),
 			Summary: &atom.Text{
 				Type: "html",
 				Body: string(html),
@@ -55,9 +57,18 @@ func atomFeed(w http.ResponseWriter, r *http.Request) {
 	buf, err := xml.Marshal(feed)
 	buf = append([]byte("<?xml version=\"1.0\" encoding=\"utf-8\"?>"), buf...)
 	httpCheck(err)
-	if err := os.WriteFile("data/www/feed.atom", buf, 0644); err != nil {
+	os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err := os.WriteFile(cachePath, buf, 0644); err != nil {
 		log.Printf("writing atom file: %v", err)
 	}
 	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
 	w.Write(buf)
 }
+
+// postAuthor returns the author for a feed entry if it differs from the blog author.
+func postAuthor(p *post) *atom.Person {
+	if p.Author == "" || p.Author == config.BlogAuthor {
+		return nil
+	}
+	return &atom.Person{Name: p.Author}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	imagelib "image"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	textTemplate "text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/mjl-/sconf"
+)
+
+// fsckProblem is an inconsistency found in the data directory or config.
+type fsckProblem struct {
+	Msg string // Starts with the path of the file.
+
+	// For problems with a safe repair, e.g. moving a stray file out of the way.
+	FixMsg string
+	fix    func() error
+}
+
+type fscker struct {
+	problems []fsckProblem
+}
+
+func (f *fscker) errorf(path, format string, args ...interface{}) {
+	f.problems = append(f.problems, fsckProblem{Msg: path + ": " + fmt.Sprintf(format, args...)})
+}
+
+// lostFound adds a problem that is fixed by moving path to data/lost+found/,
+// keeping its path relative to data/.
+func (f *fscker) lostFound(path, format string, args ...interface{}) {
+	dst := filepath.Join("data/lost+found", strings.TrimPrefix(path, "data/"))
+	f.problems = append(f.problems, fsckProblem{
+		Msg:    path + ": " + fmt.Sprintf(format, args...),
+		FixMsg: "move to " + dst,
+		fix: func() error {
+			if err := ensureDir(filepath.Dir(dst)); err != nil {
+				return err
+			}
+			if err := os.Rename(path, dst); err != nil {
+				return err
+			}
+			return syncDir(filepath.Dir(path))
+		},
+	})
+}
+
+// stale adds a problem for a leftover temporary file from an interrupted write.
+func (f *fscker) stale(path string) {
+	f.problems = append(f.problems, fsckProblem{
+		Msg:    path + ": leftover temporary file",
+		FixMsg: "remove",
+		fix: func() error {
+			return os.Remove(path)
+		},
+	})
+}
+
+// listDir returns the entries in dir, reporting leftover temporary files.
+func (f *fscker) listDir(dir string) []os.DirEntry {
+	l, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			f.errorf(dir, "listing directory: %v", err)
+		}
+		return nil
+	}
+	var r []os.DirEntry
+	for _, fi := range l {
+		if strings.HasPrefix(fi.Name(), ".") {
+			if strings.HasSuffix(fi.Name(), ".tmp") {
+				f.stale(dir + "/" + fi.Name())
+			}
+			continue
+		}
+		r = append(r, fi)
+	}
+	return r
+}
+
+func fsck(args []string) {
+	fl := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := fl.Bool("fix", false, "Repair problems that can be repaired safely: leftover temporary files are removed, stray files and directories are moved to data/lost+found/")
+	fl.Usage = func() {
+		log.Printf("usage: blogx fsck [-fix] [blogx.conf]")
+		log.Printf("Checks the data directory in the current directory, and the config file if specified, for problems. Stop blogx serve before using -fix.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	args = fl.Args()
+	if len(args) > 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	var problems []fsckProblem
+	if len(args) == 1 {
+		if err := sconf.ParseFile(args[0], &config); err != nil {
+			problems = append(problems, fsckProblem{Msg: fmt.Sprintf("%s: parsing config: %v", args[0], err)})
+		} else {
+			problems = append(problems, fsckConfig(args[0])...)
+		}
+	}
+	problems = append(problems, fsckData()...)
+
+	var nfixed int
+	for _, p := range problems {
+		switch {
+		case p.fix == nil:
+			log.Printf("%s", p.Msg)
+		case !*fix:
+			log.Printf("%s (-fix will %s)", p.Msg, p.FixMsg)
+		default:
+			if err := p.fix(); err != nil {
+				log.Printf("%s (fix failed: %v)", p.Msg, err)
+			} else {
+				log.Printf("%s (fixed)", p.Msg)
+				nfixed++
+			}
+		}
+	}
+	log.Printf("%d problems, %d fixed", len(problems), nfixed)
+	if len(problems)-nfixed > 0 {
+		os.Exit(1)
+	}
+}
+
+// fsckConfig checks the loaded config for mistakes that blogx would not
+// notice until it misbehaves.
+func fsckConfig(path string) []fsckProblem {
+	f := &fscker{}
+
+	if config.BaseURL == "" {
+		f.errorf(path, "BaseURL is not set")
+	} else if u, err := url.Parse(config.BaseURL); err != nil {
+		f.errorf(path, "BaseURL: %v", err)
+	} else {
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			f.errorf(path, "BaseURL %q must be an absolute http or https URL", config.BaseURL)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			f.errorf(path, "BaseURL %q must end with a slash", config.BaseURL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			f.errorf(path, "BaseURL %q must not have a query or fragment", config.BaseURL)
+		}
+	}
+	if config.Password == "" {
+		f.errorf(path, "Password is not set, logging in to the admin is not possible")
+	}
+	if len(config.CookieAuthKey) < 16 {
+		f.errorf(path, "CookieAuthKey should be a random string of at least 16 characters")
+	}
+	if config.BlogTitle == "" {
+		f.errorf(path, "BlogTitle is not set")
+	}
+	if config.BlogAuthor == "" {
+		f.errorf(path, "BlogAuthor is not set, it is required in the atom feed")
+	}
+	if m := config.Mail; m.Host != "" {
+		if m.Port == 0 {
+			f.errorf(path, "Mail.Port is not set")
+		}
+		if m.From == "" || m.To == "" {
+			f.errorf(path, "Mail.From and Mail.To must be set")
+		}
+		if m.TLS && m.STARTTLS {
+			f.errorf(path, "Mail.TLS and Mail.STARTTLS cannot both be set")
+		}
+	}
+	if config.ThemeDir != "" {
+		f.checkTheme(config.ThemeDir)
+	}
+	return f.problems
+}
+
+// checkTheme checks that the templates in theme directory dir parse, and that
+// they override a default template, other templates are never used.
+func (f *fscker) checkTheme(dir string) {
+	if fi, err := os.Stat(dir); err != nil {
+		f.errorf(dir, "ThemeDir: %v", err)
+		return
+	} else if !fi.IsDir() {
+		f.errorf(dir, "ThemeDir is not a directory")
+		return
+	}
+	err := fs.WalkDir(os.DirFS(dir), "t", func(path string, d fs.DirEntry, err error) error {
+		if err != nil && errors.Is(err, fs.ErrNotExist) && path == "t" {
+			return fs.SkipDir
+		} else if err != nil {
+			return err
+		}
+		p := filepath.Join(dir, filepath.FromSlash(path))
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if _, err := fs.Stat(fsys, "assets/"+path); err != nil {
+			f.errorf(p, "template does not override a default template, it is not used")
+			return nil
+		}
+		buf, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if _, err := template.New(path).Funcs(funcs).Parse(string(buf)); err != nil {
+			f.errorf(p, "parsing template: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		f.errorf(dir, "checking theme: %v", err)
+	}
+}
+
+// fsckData checks all files in the data directory, and the references between them.
+func fsckData() []fsckProblem {
+	f := &fscker{}
+	var posts []*post
+	var images []*image
+	postPaths := map[*post]string{}
+
+	for _, fi := range f.listDir("data/post") {
+		dir := "data/post/" + fi.Name()
+		if !fi.IsDir() {
+			f.lostFound(dir, "unexpected file")
+			continue
+		}
+		if _, err := os.Stat(dir + "/post.txt"); err != nil && os.IsNotExist(err) {
+			if _, err := os.Stat(dir + "/comment"); err == nil {
+				f.lostFound(dir, "comment directory without post")
+			} else {
+				f.lostFound(dir, "post directory without post.txt")
+			}
+			continue
+		}
+		for _, e := range f.listDir(dir) {
+			switch e.Name() {
+			case "post.txt", "comment", "revisions":
+			default:
+				f.lostFound(dir+"/"+e.Name(), "unexpected file")
+			}
+		}
+
+		p, err := readPost(dir+"/post.txt", fi.Name())
+		if err != nil {
+			f.errorf(dir+"/post.txt", "%v", strings.TrimPrefix(err.Error(), dir+"/post.txt: "))
+		} else {
+			posts = append(posts, p)
+			postPaths[p] = dir + "/post.txt"
+		}
+
+		for _, e := range f.listDir(dir + "/comment") {
+			path := dir + "/comment/" + e.Name()
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
+				f.lostFound(path, "unexpected file")
+				continue
+			}
+			if _, err := readComment(path, fi.Name(), strings.TrimSuffix(e.Name(), ".txt")); err != nil {
+				f.errorf(path, "%v", strings.TrimPrefix(err.Error(), path+": "))
+			}
+		}
+
+		for _, e := range f.listDir(dir + "/revisions") {
+			path := dir + "/revisions/" + e.Name()
+			if _, err := time.Parse(revisionTimeFormat, strings.TrimSuffix(e.Name(), ".txt")); err != nil || !strings.HasSuffix(e.Name(), ".txt") {
+				f.lostFound(path, "unexpected file, revisions are named <time>.txt")
+				continue
+			}
+			if _, err := readPost(path, fi.Name()); err != nil {
+				f.errorf(path, "%v", strings.TrimPrefix(err.Error(), path+": "))
+			}
+		}
+	}
+
+	var pages []*page
+	for _, fi := range f.listDir("data/page") {
+		dir := "data/page/" + fi.Name()
+		if !fi.IsDir() {
+			f.lostFound(dir, "unexpected file")
+			continue
+		}
+		if _, err := os.Stat(dir + "/page.txt"); err != nil && os.IsNotExist(err) {
+			f.lostFound(dir, "page directory without page.txt")
+			continue
+		}
+		for _, e := range f.listDir(dir) {
+			if e.Name() != "page.txt" {
+				f.lostFound(dir+"/"+e.Name(), "unexpected file")
+			}
+		}
+		pg, err := readPage(dir+"/page.txt", fi.Name())
+		if err != nil {
+			f.errorf(dir+"/page.txt", "%v", strings.TrimPrefix(err.Error(), dir+"/page.txt: "))
+			continue
+		}
+		pages = append(pages, pg)
+	}
+
+	for _, fi := range f.listDir("data/image") {
+		dir := "data/image/" + fi.Name()
+		if !fi.IsDir() {
+			f.lostFound(dir, "unexpected file")
+			continue
+		}
+		if _, err := os.Stat(dir + "/image.txt"); err != nil && os.IsNotExist(err) {
+			f.lostFound(dir, "image directory without image.txt")
+			continue
+		}
+		img, err := readImage(dir+"/image.txt", fi.Name())
+		if err != nil {
+			f.errorf(dir+"/image.txt", "%v", strings.TrimPrefix(err.Error(), dir+"/image.txt: "))
+			continue
+		}
+		images = append(images, img)
+
+		for _, e := range f.listDir(dir) {
+			if e.Name() != "image.txt" && e.Name() != img.Filename && e.Name() != img.Poster {
+				f.lostFound(dir+"/"+e.Name(), "orphaned image data file, image.txt references %q", img.Filename)
+			}
+		}
+		data, err := img.Data()
+		if err != nil {
+			f.errorf(dir+"/"+img.Filename, "reading image data: %v", err)
+		} else if strings.HasPrefix(img.Mimetype, "image/") {
+			if _, _, err := imagelib.DecodeConfig(bytes.NewReader(data)); err != nil {
+				f.errorf(dir+"/"+img.Filename, "decoding image: %v", err)
+			}
+		}
+		if img.Poster != "" {
+			if data, err := img.PosterData(); err != nil {
+				f.errorf(dir+"/"+img.Poster, "reading poster: %v", err)
+			} else if _, _, err := imagelib.DecodeConfig(bytes.NewReader(data)); err != nil {
+				f.errorf(dir+"/"+img.Poster, "decoding poster: %v", err)
+			}
+		}
+	}
+
+	redirects, err := readRedirects("data/redirects.txt")
+	if err != nil {
+		f.errorf("data/redirects.txt", "%v", strings.TrimPrefix(err.Error(), "data/redirects.txt: "))
+	}
+
+	// References between the files.
+	slugs := map[string]*post{}
+	for _, p := range posts {
+		if op, ok := slugs[p.Slug]; ok {
+			f.errorf(postPaths[p], "slug %q already used by post %s", p.Slug, op.ID)
+		} else {
+			slugs[p.Slug] = p
+		}
+	}
+	oldSlugs := map[string]*post{}
+	for _, p := range posts {
+		for _, s := range p.OldSlugs {
+			if op, ok := slugs[s]; ok && op != p {
+				f.errorf(postPaths[p], "old slug %q is the current slug of post %s", s, op.ID)
+			} else if op, ok := oldSlugs[s]; ok && op != p {
+				f.errorf(postPaths[p], "old slug %q is also an old slug of post %s", s, op.ID)
+			}
+			oldSlugs[s] = p
+		}
+		if !p.Publish.IsZero() && !p.Expire.IsZero() && !p.Publish.Before(p.Expire) {
+			f.errorf(postPaths[p], "expire time %s is not after publish time %s", p.Expire.Format(time.RFC3339), p.Publish.Format(time.RFC3339))
+		}
+	}
+
+	imageSlugs := map[string]*image{}
+	for _, img := range images {
+		if oimg, ok := imageSlugs[img.Slug]; ok {
+			f.errorf("data/image/"+img.ID+"/image.txt", "slug %q already used by image %s", img.Slug, oimg.ID)
+		} else {
+			imageSlugs[img.Slug] = img
+		}
+	}
+
+	// For checking image: and post: references in markdown, and shortcodes.
+	refData := &store{Posts: posts, Pages: pages, Images: images}
+
+	pageSlugs := map[string]*page{}
+	for _, pg := range pages {
+		path := "data/page/" + pg.ID + "/page.txt"
+		if err := checkPageSlug(pg.Slug); err != nil {
+			f.errorf(path, "%v", err)
+		}
+		if opg, ok := pageSlugs[pg.Slug]; ok {
+			f.errorf(path, "slug %q already used by page %s", pg.Slug, opg.ID)
+		} else {
+			pageSlugs[pg.Slug] = pg
+		}
+		f.checkBody(path, "body", pg.Slug, refData, imageSlugs, pg.Body, pg.LegacyTemplates)
+	}
+
+	for _, p := range posts {
+		f.checkBody(postPaths[p], "summary", "", refData, imageSlugs, p.Summary, p.LegacyTemplates)
+		f.checkBody(postPaths[p], "body", "", refData, imageSlugs, p.Body, p.LegacyTemplates)
+	}
+
+	froms := map[string]bool{}
+	for _, rd := range redirects {
+		if froms[rd.From] {
+			f.errorf("data/redirects.txt", "duplicate redirect from %q", rd.From)
+		}
+		froms[rd.From] = true
+		if slug, ok := strings.CutPrefix(rd.To, "p/"); ok && strings.HasSuffix(slug, "/") {
+			slug = strings.TrimSuffix(slug, "/")
+			if slugs[slug] == nil && oldSlugs[slug] == nil {
+				f.errorf("data/redirects.txt", "redirect from %q to post %q that does not exist", rd.From, slug)
+			}
+		}
+	}
+
+	return f.problems
+}
+
+// legacyTemplateRegexp matches template actions that use images, common in
+// bodies from before shortcodes.
+var legacyTemplateRegexp = regexp.MustCompile(`\{\{[^}]*\b(imageSlug|imageSlugRaw|inlineImage)\b`)
+
+// checkBody checks the shortcodes or legacy templates, and references in
+// markdown md, the body or summary of the post or page at path. Page is the
+// slug of the page, empty for posts.
+func (f *fscker) checkBody(path, what, page string, refData *store, imageSlugs map[string]*image, md string, legacy bool) {
+	if !legacy {
+		if err := checkShortcodes(refData, page, md); err != nil {
+			f.errorf(path, "%s: %v", what, err)
+		}
+		if legacyTemplateRegexp.MatchString(md) {
+			f.errorf(path, "%s seems to use templates, set Legacy-Templates or change to shortcodes", what)
+		}
+	} else {
+		refs, err := templateImageSlugs(md)
+		if err != nil {
+			f.errorf(path, "%s: %v", what, err)
+		}
+		for _, slug := range refs {
+			if imageSlugs[slug] == nil {
+				f.errorf(path, "%s references image slug %q that does not exist", what, slug)
+			}
+		}
+	}
+	if err := checkMarkdownRefs(refData, md); err != nil {
+		f.errorf(path, "%s: %v", what, err)
+	}
+}
+
+// templateImageSlugs parses body as a template and returns the literal slugs
+// passed to imageSlug and imageSlugRaw.
+func templateImageSlugs(body string) ([]string, error) {
+	t, err := textTemplate.New("body").Funcs(textFuncs).Parse(body)
+	if err != nil {
+		return nil, err
+	}
+	var slugs []string
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.CommandNode:
+			if len(n.Args) >= 2 {
+				if id, ok := n.Args[0].(*parse.IdentifierNode); ok && (id.Ident == "imageSlug" || id.Ident == "imageSlugRaw") {
+					if s, ok := n.Args[1].(*parse.StringNode); ok {
+						slugs = append(slugs, s.Text)
+					}
+				}
+			}
+			for _, c := range n.Args {
+				walk(c)
+			}
+		}
+	}
+	if t.Tree != nil {
+		walk(t.Tree.Root)
+	}
+	return slugs, nil
+}
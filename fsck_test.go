@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemplateImageSlugs(t *testing.T) {
+	test := func(body string, xslugs []string, xerr bool) {
+		t.Helper()
+		slugs, err := templateImageSlugs(body)
+		if (err != nil) != xerr {
+			t.Fatalf("%q: got err %v, expected error %v", body, err, xerr)
+		}
+		if !reflect.DeepEqual(slugs, xslugs) {
+			t.Fatalf("%q: got slugs %q, expected %q", body, slugs, xslugs)
+		}
+	}
+
+	test("no templates", nil, false)
+	test(`{{imageSlug "a" | thumbnail 600 400 | inlineImage}}`, []string{"a"}, false)
+	test(`{{if true}}{{with imageSlugRaw "b"}}{{.Title}}{{end}}{{else}}{{inlineImage (imageSlug "c")}}{{end}}`, []string{"b", "c"}, false)
+	test(`{{imageSlug .}}`, nil, false)
+	test(`{{imageSlug "a"`, nil, true)
+	test(`{{nosuchfunc}}`, nil, true)
+}
+
+func TestFsckConfig(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	test := func(baseURL string, xproblems int) {
+		t.Helper()
+		config = saved
+		config.BaseURL = baseURL
+		config.Password = "test"
+		config.CookieAuthKey = "0123456789abcdef"
+		config.BlogTitle = "Blog"
+		config.BlogAuthor = "Author"
+		if l := fsckConfig("blogx.conf"); len(l) != xproblems {
+			t.Fatalf("%q: got problems %v, expected %d", baseURL, l, xproblems)
+		}
+	}
+
+	test("https://example.org/", 0)
+	test("https://example.org/blog/", 0)
+	test("https://example.org/blog", 1)
+	test("https://example.org", 1)
+	test("/blog/", 1)
+	test("https://example.org/?x=1", 1)
+	test("", 1)
+}
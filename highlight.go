@@ -0,0 +1,341 @@
+package main
+
+import (
+	"go/scanner"
+	"go/token"
+	"html"
+	"strings"
+)
+
+// Code in fenced blocks is highlighted at render time, pages are standalone
+// and cannot load a highlighter. Tokens are wrapped in spans with classes
+// styled in style.css:
+//
+//	hl-kw	keyword
+//	hl-str	string
+//	hl-com	comment
+//	hl-num	number
+//	hl-lit	constant like true, false, nil, null
+//	hl-bi	builtin function or type
+//	hl-key	key in json/yaml
+//	hl-var	shell variable
+//	hl-meta	diff header, yaml document marker
+//	hl-ins	added line in diff
+//	hl-del	removed line in diff
+
+var highlighters = map[string]func(string) string{
+	"go":      highlightGo,
+	"golang":  highlightGo,
+	"sh":      highlightShell,
+	"shell":   highlightShell,
+	"bash":    highlightShell,
+	"console": highlightShell,
+	"json":    highlightJSON,
+	"yaml":    highlightYAML,
+	"yml":     highlightYAML,
+	"diff":    highlightDiff,
+	"patch":   highlightDiff,
+}
+
+// highlight returns code as html with highlighted tokens. False is returned for
+// unknown languages.
+func highlight(lang, code string) (string, bool) {
+	fn, ok := highlighters[strings.ToLower(lang)]
+	if !ok {
+		return "", false
+	}
+	return fn(code), true
+}
+
+type hlWriter struct {
+	b strings.Builder
+}
+
+func (h *hlWriter) text(s string) {
+	h.b.WriteString(html.EscapeString(s))
+}
+
+func (h *hlWriter) span(class, s string) {
+	if s == "" {
+		return
+	}
+	h.b.WriteString(`<span class="hl-` + class + `">`)
+	h.text(s)
+	h.b.WriteString("</span>")
+}
+
+var goLits = map[string]bool{"true": true, "false": true, "nil": true, "iota": true}
+
+var goBuiltins = map[string]bool{}
+
+func init() {
+	for _, s := range strings.Fields(`any append bool byte cap clear close comparable complex complex64 complex128 copy delete error float32 float64 imag int int8 int16 int32 int64 len make max min new panic print println real recover rune string uint uint8 uint16 uint32 uint64 uintptr`) {
+		goBuiltins[s] = true
+	}
+}
+
+func highlightGo(src string) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	// Snippets need not be valid Go, errors are ignored.
+	s.Init(file, []byte(src), func(token.Position, string) {}, scanner.ScanComments)
+
+	var h hlWriter
+	cur := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		var class string
+		switch {
+		case tok == token.COMMENT:
+			class = "com"
+		case tok == token.STRING || tok == token.CHAR:
+			class = "str"
+		case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+			class = "num"
+		case tok.IsKeyword():
+			class = "kw"
+		case tok == token.IDENT && goLits[lit]:
+			class = "lit"
+		case tok == token.IDENT && goBuiltins[lit]:
+			class = "bi"
+		default:
+			continue
+		}
+		// The scanner removes carriage returns from some literals, leave those as text.
+		off := file.Offset(pos)
+		if off < cur || off+len(lit) > len(src) || src[off:off+len(lit)] != lit {
+			continue
+		}
+		h.text(src[cur:off])
+		h.span(class, lit)
+		cur = off + len(lit)
+	}
+	h.text(src[cur:])
+	return h.b.String()
+}
+
+// quotedEnd returns the offset just after the string starting with a quote at
+// s[i], or the end of the line for an unterminated string.
+func quotedEnd(s string, i int, backslash bool) int {
+	q := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch {
+		case backslash && s[j] == '\\':
+			j++
+		case s[j] == q:
+			return j + 1
+		case s[j] == '\n' && q != '\'':
+			return j
+		}
+	}
+	return len(s)
+}
+
+func lineEnd(s string, i int) int {
+	if j := strings.IndexByte(s[i:], '\n'); j >= 0 {
+		return i + j
+	}
+	return len(s)
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func wordEnd(s string, i int, extra string) int {
+	for i < len(s) && (isWordChar(s[i]) || strings.IndexByte(extra, s[i]) >= 0) {
+		i++
+	}
+	return i
+}
+
+var shellKeywords = map[string]bool{}
+
+func init() {
+	for _, s := range strings.Fields(`if then else elif fi for while until do done case esac in function select return export local readonly set unset shift exit break continue`) {
+		shellKeywords[s] = true
+	}
+}
+
+func highlightShell(src string) string {
+	var h hlWriter
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '#' && (i == 0 || strings.IndexByte(" \t\n;", src[i-1]) >= 0):
+			j := lineEnd(src, i)
+			h.span("com", src[i:j])
+			i = j
+		case c == '\'' || c == '"':
+			j := quotedEnd(src, i, c == '"')
+			h.span("str", src[i:j])
+			i = j
+		case c == '$' && i+1 < len(src) && src[i+1] == '{':
+			j := strings.IndexByte(src[i:], '}')
+			if j < 0 {
+				j = len(src)
+			} else {
+				j += i + 1
+			}
+			h.span("var", src[i:j])
+			i = j
+		case c == '$' && i+1 < len(src) && strings.IndexByte("0123456789@#?$!*-", src[i+1]) >= 0:
+			h.span("var", src[i:i+2])
+			i += 2
+		case c == '$' && i+1 < len(src) && isWordChar(src[i+1]):
+			j := wordEnd(src, i+1, "")
+			h.span("var", src[i:j])
+			i = j
+		case isWordChar(c):
+			// Words include dashes and dots so "if" in "my-if" or "x.done" is not a keyword.
+			j := wordEnd(src, i, "-./")
+			if w := src[i:j]; shellKeywords[w] {
+				h.span("kw", w)
+			} else {
+				h.text(w)
+			}
+			i = j
+		default:
+			h.text(src[i : i+1])
+			i++
+		}
+	}
+	return h.b.String()
+}
+
+func highlightJSON(src string) string {
+	var h hlWriter
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"':
+			j := quotedEnd(src, i, true)
+			class := "str"
+			if strings.HasPrefix(strings.TrimLeft(src[j:], " \t\r\n"), ":") {
+				class = "key"
+			}
+			h.span(class, src[i:j])
+			i = j
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := wordEnd(src, i+1, ".+-")
+			h.span("num", src[i:j])
+			i = j
+		case isWordChar(c):
+			j := wordEnd(src, i, "")
+			switch w := src[i:j]; w {
+			case "true", "false", "null":
+				h.span("lit", w)
+			default:
+				h.text(w)
+			}
+			i = j
+		default:
+			h.text(src[i : i+1])
+			i++
+		}
+	}
+	return h.b.String()
+}
+
+func highlightYAML(src string) string {
+	var h hlWriter
+	lines := strings.SplitAfter(src, "\n")
+	for _, line := range lines {
+		s, nl := strings.CutSuffix(line, "\n")
+		trimmed := strings.TrimLeft(s, " \t")
+		indent := s[:len(s)-len(trimmed)]
+		h.text(indent)
+		switch {
+		case strings.HasPrefix(trimmed, "#"):
+			h.span("com", trimmed)
+		case trimmed == "---" || trimmed == "..." || strings.HasPrefix(trimmed, "--- "):
+			h.span("meta", trimmed)
+		default:
+			highlightYAMLLine(&h, trimmed)
+		}
+		if nl {
+			h.text("\n")
+		}
+	}
+	return h.b.String()
+}
+
+func highlightYAMLLine(h *hlWriter, s string) {
+	for strings.HasPrefix(s, "- ") {
+		h.text("- ")
+		s = s[2:]
+	}
+	if s != "" && strings.IndexByte(`#'"{}[],&*!|>%@`, s[0]) < 0 {
+		if i := strings.Index(s+" ", ": "); i > 0 && !strings.Contains(s[:i], " #") {
+			h.span("key", s[:i])
+			h.text(":")
+			s = s[i+1:]
+		}
+	}
+
+	// Value, with optional comment.
+	var comment string
+	if i := strings.Index(" "+s, " #"); i >= 0 {
+		if i == 0 {
+			s, comment = "", s
+		} else {
+			s, comment = s[:i], s[i:]
+		}
+	}
+	v := strings.TrimSpace(s)
+	lead := s[:strings.Index(s, v)]
+	h.text(lead)
+	switch {
+	case v == "":
+	case len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0]:
+		h.span("str", v)
+	case yamlLits[v]:
+		h.span("lit", v)
+	case isNumber(v):
+		h.span("num", v)
+	default:
+		h.text(v)
+	}
+	h.text(s[len(lead)+len(v):])
+	h.span("com", comment)
+}
+
+var yamlLits = map[string]bool{"true": true, "false": true, "yes": true, "no": true, "null": true, "~": true}
+
+func isNumber(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c == '.' || c == '_' || c == 'e' || c == 'E' || c == 'x' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func highlightDiff(src string) string {
+	var h hlWriter
+	for _, line := range strings.SplitAfter(src, "\n") {
+		s, nl := strings.CutSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(s, "+++ ") || strings.HasPrefix(s, "--- ") || strings.HasPrefix(s, "diff ") || strings.HasPrefix(s, "index ") || strings.HasPrefix(s, "@@"):
+			h.span("meta", s)
+		case strings.HasPrefix(s, "+"):
+			h.span("ins", s)
+		case strings.HasPrefix(s, "-"):
+			h.span("del", s)
+		default:
+			h.text(s)
+		}
+		if nl {
+			h.text("\n")
+		}
+	}
+	return h.b.String()
+}
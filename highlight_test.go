@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHighlight(t *testing.T) {
+	test := func(lang, code, exp string) {
+		t.Helper()
+		r, ok := highlight(lang, code)
+		if !ok {
+			t.Fatalf("highlight %q: unknown language", lang)
+		}
+		if r != exp {
+			t.Fatalf("highlight %s %q: got %q, expected %q", lang, code, r, exp)
+		}
+	}
+
+	test("go", "if x := len(s); x > 0 { // <ok>\n\treturn \"a\", nil\n}\n", `<span class="hl-kw">if</span> x := <span class="hl-bi">len</span>(s); x &gt; <span class="hl-num">0</span> { <span class="hl-com">// &lt;ok&gt;</span>`+"\n\t"+`<span class="hl-kw">return</span> <span class="hl-str">&#34;a&#34;</span>, <span class="hl-lit">nil</span>`+"\n}\n")
+	test("go", "x := `a\nb` @", "x := <span class=\"hl-str\">`a\nb`</span> @")
+	test("sh", "for f in $HOME/*; do echo \"${f}\" 'x' # done\ndone\n", `<span class="hl-kw">for</span> f <span class="hl-kw">in</span> <span class="hl-var">$HOME</span>/*; <span class="hl-kw">do</span> echo <span class="hl-str">&#34;${f}&#34;</span> <span class="hl-str">&#39;x&#39;</span> <span class="hl-com"># done</span>`+"\n"+`<span class="hl-kw">done</span>`+"\n")
+	test("bash", "my-if a#b $1", `my-if a#b <span class="hl-var">$1</span>`)
+	test("json", `{"a": [1, -2.5e3, true, null, "x"]}`, `{<span class="hl-key">&#34;a&#34;</span>: [<span class="hl-num">1</span>, <span class="hl-num">-2.5e3</span>, <span class="hl-lit">true</span>, <span class="hl-lit">null</span>, <span class="hl-str">&#34;x&#34;</span>]}`)
+	test("yaml", "---\n# c\nname: blog # x\nlist:\n  - port: 80\n  - 'q'\nurl: http://x\n", `<span class="hl-meta">---</span>`+"\n"+`<span class="hl-com"># c</span>`+"\n"+`<span class="hl-key">name</span>: blog <span class="hl-com"># x</span>`+"\n"+`<span class="hl-key">list</span>:`+"\n  - "+`<span class="hl-key">port</span>: <span class="hl-num">80</span>`+"\n  - "+`<span class="hl-str">&#39;q&#39;</span>`+"\n"+`<span class="hl-key">url</span>: http://x`+"\n")
+	test("diff", "--- a\n+++ b\n@@ -1 +1 @@\n-x\n+y\n z", `<span class="hl-meta">--- a</span>`+"\n"+`<span class="hl-meta">+++ b</span>`+"\n"+`<span class="hl-meta">@@ -1 +1 @@</span>`+"\n"+`<span class="hl-del">-x</span>`+"\n"+`<span class="hl-ins">+y</span>`+"\n z")
+
+	if _, ok := highlight("cobol", "x"); ok {
+		t.Fatalf("highlight for unknown language")
+	}
+}
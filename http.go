@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
@@ -27,37 +28,76 @@ func cthtml(w http.ResponseWriter) {
 	w.Header().Set("content-type", "text/html; charset=utf-8")
 }
 
-func renderText(s string) (string, error) {
+func renderText(s string, budget *imageBudget) (string, error) {
 	b := &bytes.Buffer{}
-	err := parseTextTemplateString("renderText", s).Execute(b, map[string]interface{}{})
+	t := parseTextTemplateString("renderText", s).Funcs(budget.textFuncs())
+	err := t.Execute(b, map[string]interface{}{})
 	if err != nil {
 		return "", err
 	}
 	return b.String(), nil
 }
 
-func renderMarkdown(md string) (template.HTML, error) {
-	nmd, err := renderText(md)
+// renderBudgetMarkdown renders markdown md with its shortcodes, or with legacy,
+// after executing md as template.
+func renderBudgetMarkdown(md string, legacy bool, budget *imageBudget) (template.HTML, error) {
+	if !legacy {
+		return template.HTML(renderShortcodeMarkdown(md, budget)), nil
+	}
+	nmd, err := renderText(md, budget)
 	if err != nil {
 		return template.HTML(""), err
 	}
-	r := string(headerMarkdown([]byte(nmd)))
-	return template.HTML(r), nil
+	r := newHeaderHTMLRenderer()
+	r.budget = budget
+	return template.HTML(r.markdown([]byte(nmd))), nil
 }
 
-func renderShortMarkdown(md string) (template.HTML, error) {
-	md, err := renderText(md)
+func renderShortMarkdown(md string, budget *imageBudget) (template.HTML, error) {
+	h, err := renderBudgetMarkdown(md, false, budget)
 	if err != nil {
 		return template.HTML(""), err
 	}
-	s := string(headerMarkdown([]byte(md)))
-	s, err = htmltrunc(s)
+	return truncateSummary(h)
+}
+
+// truncateSummary returns html h truncated to the configured summary length.
+func truncateSummary(h template.HTML) (template.HTML, error) {
+	s := string(h)
+	n := config.SummaryLength
+	if n <= 0 {
+		n = 275
+	}
+	s, err := htmltrunc(s, n)
 	if err != nil {
 		return template.HTML(""), err
 	}
 	return template.HTML(s), nil
 }
 
+// moreMarker in a post body ends the part shown on the index and in feeds.
+const moreMarker = "<!--more-->"
+
+// renderSummary returns the html shown for a post on the index and in feeds:
+// its summary if set, otherwise the body up to the more marker, otherwise the
+// body truncated to the configured length. A table of contents is only shown
+// with the full post. Images count against budget, shared by all summaries on
+// the index or in the feed.
+func renderSummary(p *post, budget *imageBudget) (template.HTML, error) {
+	if p.Summary != "" {
+		return renderBudgetMarkdown(p.Summary, p.LegacyTemplates, budget)
+	}
+	body := strings.ReplaceAll(p.Body, tocMarker, "")
+	if before, _, ok := strings.Cut(body, moreMarker); ok {
+		return renderBudgetMarkdown(before, p.LegacyTemplates, budget)
+	}
+	h, err := renderBudgetMarkdown(body, p.LegacyTemplates, budget)
+	if err != nil {
+		return template.HTML(""), err
+	}
+	return truncateSummary(h)
+}
+
 func init() {
 	funcs = template.FuncMap{
 		"date": formatDate,
@@ -65,22 +105,30 @@ func init() {
 			return tm.Format(time.RFC3339)
 		},
 		"slug2url": slug2url,
+		"tag2url":  tag2url,
+		"page2url": page2url,
 		"age": func(tm time.Time) string {
 			return mkage(time.Now().Unix() - tm.Unix())
 		},
-		"inlineCSS":           inlineCSS,
-		"inlineImage":         inlineImage,
-		"image2img":           image2img,
-		"imagePath":           imagePath,
-		"imageSlug":           imageSlug,
-		"imageSlugRaw":        imageSlugRaw,
-		"activeCommentCount":  activeCommentCount,
-		"hasPrefix":           hasPrefix,
-		"thumbnail":           thumbnail,
-		"resize":              resize,
-		"render":              render,
-		"renderMarkdown":      renderMarkdown,
-		"renderShortMarkdown": renderShortMarkdown,
+		"inlineCSS":          inlineCSS,
+		"inlineImage":        inlineImage,
+		"image2img":          image2img,
+		"imagePath":          imagePath,
+		"imageSlug":          imageSlug,
+		"imageSlugRaw":       imageSlugRaw,
+		"activeCommentCount": activeCommentCount,
+		"menu":               menu,
+		"hasPrefix":          hasPrefix,
+		"thumbnail":          thumbnail,
+		"resize":             resize,
+		"toJPEG":             toJPEG,
+		"toPNG":              toPNG,
+		"crop":               crop,
+		"rotate":             rotate,
+		"grayscale":          grayscale,
+		"figure":             figure,
+		"video":              video,
+		"render":             render,
 		"csrf": func() template.HTML {
 			return template.HTML(fmt.Sprintf(`<input type="hidden" name="csrf" value="%s" />`, generateAuth([]byte(config.CookieAuthKey))))
 		},
@@ -93,21 +141,29 @@ func init() {
 		"blogtitle": func() string {
 			return config.BlogTitle
 		},
+		"blogauthor": func() string {
+			return config.BlogAuthor
+		},
 		"version": func() string {
 			return version
 		},
 	}
+	// Replaced by servePage with functions for the budget of the page.
+	for k, v := range (*imageBudget)(nil).renderFuncs() {
+		funcs[k] = v
+	}
+	// Functions for legacy templates in bodies, which are written by anyone who
+	// can edit posts. Without imagePath and render, which can read any file.
 	textFuncs = textTemplate.FuncMap{}
 	for k, v := range funcs {
-		textFuncs[k] = v
+		if k != "imagePath" && k != "render" {
+			textFuncs[k] = v
+		}
 	}
 }
 
 func parseTemplate(path string) *template.Template {
-	f, err := fsys.Open("assets/" + path)
-	httpCheck(err)
-	defer f.Close()
-	templ, err := io.ReadAll(f)
+	templ, err := fs.ReadFile(assetFS(), path)
 	httpCheck(err)
 	return template.Must(template.New(path).Funcs(funcs).Parse(string(templ)))
 }
@@ -147,12 +203,15 @@ func publicComment(slug string, w http.ResponseWriter, r *http.Request) {
 		author = "anonymous"
 	}
 
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	defer storeChanged()
 	data, err := readStore()
 	httpCheck(err)
 	defer removeWritethrough(fmt.Sprintf("data/www/p/%s/index.html", slug))
 
 	p := data.findPostBySlug(slug)
-	if p == nil || !p.Active {
+	if p == nil || !p.Published(time.Now()) {
 		abort(404)
 	}
 
@@ -163,14 +222,20 @@ func publicComment(slug string, w http.ResponseWriter, r *http.Request) {
 	}
 
 	active := !strings.Contains(body, "http://") && !strings.Contains(body, "https://") && !emailregexp.MatchString(body)
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		address = r.RemoteAddr
+	}
 	c := &comment{
-		ID:     newID(),
-		PostID: p.ID,
-		Active: active,
-		Seen:   false,
-		Time:   time.Now(),
-		Author: author,
-		Body:   body,
+		ID:        newID(),
+		PostID:    p.ID,
+		Active:    active,
+		Seen:      false,
+		Time:      time.Now(),
+		Author:    author,
+		Address:   address,
+		UserAgent: r.UserAgent(),
+		Body:      body,
 	}
 	err = writeComment(c)
 	httpCheck(err)
@@ -266,18 +331,35 @@ func publicPost(w http.ResponseWriter, r *http.Request) {
 
 	needGet(r)
 
-	data, err := readStore()
+	data, err := loadStore()
 	httpCheck(err)
 	p := data.findPostBySlug(slug)
-	if p == nil || !p.Active {
+	if p == nil {
+		if op := data.findPostByOldSlug(slug); op != nil && op.Published(time.Now()) {
+			http.Redirect(w, r, fmt.Sprintf("%sp/%s/", config.BaseURL, op.Slug), http.StatusMovedPermanently)
+			return
+		}
+		if serveRedirect(w, r, data) {
+			return
+		}
+	}
+	if p == nil || !p.Published(time.Now()) {
 		abort(404)
 	}
 
+	servePage(w, "t/post.html", map[string]interface{}{
+		"post": p,
+	}, postBudget(p), fmt.Sprintf("data/www/p/%s/index.html", slug))
+}
+
+// servePage executes the template with params, compacts the html and writes it
+// to the response. Images inlined in the page count against budget. The page is
+// also stored at cachePath in data/www, to be served directly by the web server
+// until removeWritethrough removes it.
+func servePage(w http.ResponseWriter, templatePath string, params map[string]interface{}, budget *imageBudget, cachePath string) {
 	var b bytes.Buffer
 	ch, cw := Compacter(&b)
-	err = parseTemplate("t/post.html").Execute(cw, map[string]interface{}{
-		"post": p,
-	})
+	err := parseTemplate(templatePath).Funcs(budget.renderFuncs()).Execute(cw, params)
 	cw.Close()
 	<-ch
 	httpCheck(err)
@@ -286,9 +368,8 @@ func publicPost(w http.ResponseWriter, r *http.Request) {
 	buf := b.Bytes()
 	w.Write(buf)
 
-	ppath := fmt.Sprintf("data/www/p/%s/index.html", slug)
-	os.MkdirAll(filepath.Dir(ppath), 0755)
-	if err := os.WriteFile(ppath, buf, 0644); err != nil {
+	os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err := os.WriteFile(cachePath, buf, 0644); err != nil {
 		log.Printf("writefile: %v", err)
 	}
 }
@@ -305,45 +386,29 @@ func empty(w http.ResponseWriter, ww io.Writer, msg, url string) {
 
 func index(w http.ResponseWriter, r *http.Request) {
 	needGet(r)
-	if r.URL.Path != "" {
-		abort(404)
-	}
 
-	data, err := readStore()
+	data, err := loadStore()
 	httpCheck(err)
 
-	posts := []*post{}
-	for _, p := range data.Posts {
-		if p.Active {
-			posts = append(posts, p)
-		}
+	if r.URL.Path != "" && publicPage(w, r, data) {
+		return
+	}
+	if serveRedirect(w, r, data) {
+		return
 	}
+	if r.URL.Path != "" {
+		abort(404)
+	}
+
+	posts := data.publishedPosts()
 	olderPosts := []*post{}
 	if len(posts) > 10 {
 		posts, olderPosts = posts[:10], posts[10:]
 	}
 
-	f, err := fsys.Open("assets/t/index.html")
-	httpCheck(err)
-	defer f.Close()
-	templ, err := io.ReadAll(f)
-	httpCheck(err)
-
-	var b bytes.Buffer
-	ch, cw := Compacter(&b)
-	err = template.Must(template.New("t/index.html").Funcs(funcs).Parse(string(templ))).Execute(cw, map[string]interface{}{
+	servePage(w, "t/index.html", map[string]interface{}{
 		"posts":      posts,
 		"olderposts": olderPosts,
-	})
-	cw.Close()
-	<-ch
-	httpCheck(err)
-
-	cthtml(w)
-	buf := b.Bytes()
-	w.Write(buf)
-
-	if err := os.WriteFile("data/www/index.html", buf, 0644); err != nil {
-		log.Printf("writefile: %v", err)
-	}
+		"tags":       tagCloud(data.publishedPosts()),
+	}, newImageBudget(config.PageBudget), "data/www/index.html")
 }
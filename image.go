@@ -4,17 +4,95 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"html"
 	"html/template"
 	imagelib "image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // For converting gif images.
 	"image/jpeg"
 	"image/png"
+	"strconv"
+	"strings"
 
 	imgresize "github.com/nfnt/resize"
 )
 
+// Img is an image for templates. Operations like thumbnail are recorded, and
+// only applied when the result is needed and not in the image cache.
 type Img struct {
-	img    imagelib.Image
-	format string
+	source  *image         // Image in the store, nil if read from a path.
+	base    imagelib.Image // Decoded source, nil until needed.
+	format  string
+	ops     []imgOp
+	quality int // JPEG quality, zero for automatic based on the size.
+}
+
+type imgOp struct {
+	key string // Describes the operation and its parameters, part of the cache key.
+	fn  func(imagelib.Image) imagelib.Image
+}
+
+// with returns a copy of img with operation op added.
+func (img *Img) with(key string, fn func(imagelib.Image) imagelib.Image) *Img {
+	n := *img
+	n.ops = append(append([]imgOp{}, img.ops...), imgOp{key, fn})
+	return &n
+}
+
+func (img *Img) slug() string {
+	if img.source == nil {
+		return ""
+	}
+	return img.source.Slug
+}
+
+// resizedOnly returns whether img is an image from the store in its original
+// format, with only thumbnail and resize operations.
+func (img *Img) resizedOnly() bool {
+	if img.source == nil || img.format != image2img(img.source).format {
+		return false
+	}
+	for _, op := range img.ops {
+		if !strings.HasPrefix(op.key, "thumbnail ") && !strings.HasPrefix(op.key, "resize ") {
+			return false
+		}
+	}
+	return true
+}
+
+// image returns the decoded image with all operations applied.
+func (img *Img) image() imagelib.Image {
+	if img.base == nil {
+		data, err := img.source.Data()
+		httpCheck(err)
+		img.base, _, err = imagelib.Decode(bytes.NewReader(data))
+		httpCheck(err)
+	}
+	m := img.base
+	for _, op := range img.ops {
+		m = op.fn(m)
+	}
+	return m
+}
+
+// size returns the width and height of the image with all operations applied.
+func (img *Img) size() (int, int) {
+	if img.source == nil {
+		b := img.image().Bounds()
+		return b.Dx(), b.Dy()
+	}
+	var data []byte
+	var err error
+	if len(img.ops) == 0 {
+		data, err = img.source.Data()
+		httpCheck(err)
+	} else {
+		data, _ = img.encode()
+	}
+	c, _, err := imagelib.DecodeConfig(bytes.NewReader(data))
+	httpCheck(err)
+	return c.Width, c.Height
 }
 
 func inlineImage(o interface{}) template.URL {
@@ -24,15 +102,59 @@ func inlineImage(o interface{}) template.URL {
 	)
 	switch img := o.(type) {
 	case *Img:
-		buf := bytes.NewBuffer(nil)
-		switch img.format {
-		case "jpeg":
-			mimetype = "image/jpeg"
+		data, mimetype = img.encode()
+	case *image:
+		if img.isVideo() {
+			// Videos are too large to inline.
+			return template.URL(videoURL(img.Slug))
+		}
+		var err error
+		data, err = img.Data()
+		httpCheck(err)
+		mimetype = img.Mimetype
+	default:
+		abortUserError(fmt.Sprintf("Unexpected input %T to inlineImage.", o))
+	}
+
+	s := base64.StdEncoding.EncodeToString(data)
+	return template.URL(fmt.Sprintf("data:%s;base64,", mimetype) + s)
+}
 
+// encode returns the image file data for img, from the image cache if possible.
+func (img *Img) encode() (data []byte, mimetype string) {
+	var ext string
+	switch img.format {
+	case "jpeg":
+		mimetype, ext = "image/jpeg", "jpg"
+	case "png":
+		mimetype, ext = "image/png", "png"
+	default:
+		abortUserError("Unsupported image format for inlining.")
+	}
+	if img.source == nil {
+		return encodeImage(img.image(), img.format, img.quality), mimetype
+	}
+	key := []string{img.source.ID, img.format, fmt.Sprintf("quality %d", img.quality)}
+	for _, op := range img.ops {
+		key = append(key, op.key)
+	}
+	data = imageCache.get(strings.Join(key, "\n"), ext, func() []byte {
+		return encodeImage(img.image(), img.format, img.quality)
+	})
+	return data, mimetype
+}
+
+// encodeImage encodes m as jpeg or png. A zero quality for jpeg is chosen
+// based on the size of the image.
+func encodeImage(m imagelib.Image, format string, quality int) []byte {
+	buf := bytes.NewBuffer(nil)
+	switch format {
+	case "jpeg":
+		if quality == 0 {
 			// Calculate size on which we base quality.
 			// We limit size to between 50 and 1600, and quality between 95 and 65.
-			width := img.img.Bounds().Dx()
-			height := img.img.Bounds().Dy()
+			width := m.Bounds().Dx()
+			height := m.Bounds().Dy()
 			size := width
 			if height < size {
 				size = height
@@ -44,41 +166,156 @@ func inlineImage(o interface{}) template.URL {
 				size = 50
 			}
 
-			quality := 65 + (95-65)*(1600-50-size)/(1600-50)
-			options := &jpeg.Options{Quality: quality}
-			err := jpeg.Encode(buf, img.img, options)
-			httpCheck(err)
-		case "png":
-			mimetype = "image/png"
-			err := png.Encode(buf, img.img)
-			httpCheck(err)
-		default:
-			abortUserError("Unsupported image format for inlining.")
+			quality = 65 + (95-65)*(1600-50-size)/(1600-50)
 		}
-		data = buf.Bytes()
-	case *image:
-		var err error
-		data, err = img.Data()
+		options := &jpeg.Options{Quality: quality}
+		err := jpeg.Encode(buf, m, options)
+		httpCheck(err)
+	case "png":
+		err := png.Encode(buf, m)
 		httpCheck(err)
-		mimetype = img.Mimetype
-	default:
-		abortUserError(fmt.Sprintf("Unexpected input %T to inlineImage.", o))
 	}
-
-	s := base64.StdEncoding.EncodeToString(data)
-	return template.URL(fmt.Sprintf("data:%s;base64,", mimetype) + s)
+	return buf.Bytes()
 }
 
 func thumbnail(width, height uint, img *Img) *Img {
-	return &Img{
-		img:    imgresize.Thumbnail(width, height, img.img, imgresize.Lanczos3),
-		format: img.format,
-	}
+	return img.with(fmt.Sprintf("thumbnail %dx%d", width, height), func(m imagelib.Image) imagelib.Image {
+		return imgresize.Thumbnail(width, height, m, imgresize.Lanczos3)
+	})
 }
 
 func resize(width, height uint, img *Img) *Img {
-	return &Img{
-		img:    imgresize.Resize(width, height, img.img, imgresize.Lanczos3),
-		format: img.format,
+	return img.with(fmt.Sprintf("resize %dx%d", width, height), func(m imagelib.Image) imagelib.Image {
+		return imgresize.Resize(width, height, m, imgresize.Lanczos3)
+	})
+}
+
+// toJPEG converts img to jpeg, transparent parts are drawn on background
+// color bg, like "#fff" or "#ffffff".
+func toJPEG(bg string, img *Img) *Img {
+	c, err := parseColor(bg)
+	if err != nil {
+		abortUserError(err.Error())
+	}
+	n := img.with("background "+bg, func(m imagelib.Image) imagelib.Image {
+		r := imagelib.NewRGBA(m.Bounds())
+		draw.Draw(r, r.Bounds(), &imagelib.Uniform{c}, imagelib.Point{}, draw.Src)
+		draw.Draw(r, r.Bounds(), m, m.Bounds().Min, draw.Over)
+		return r
+	})
+	n.format = "jpeg"
+	return n
+}
+
+func toPNG(img *Img) *Img {
+	n := *img
+	n.format = "png"
+	return &n
+}
+
+// parseColor parses colors like "#fff" and "#ffffff".
+func parseColor(s string) (color.Color, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	v, err := strconv.ParseUint(h, 16, 32)
+	if len(h) != 6 || err != nil {
+		return nil, fmt.Errorf("bad color %q, must be like #fff or #ffffff", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
+
+// crop returns the part of img of width by height at x,y from the top left.
+func crop(x, y, width, height int, img *Img) *Img {
+	if x < 0 || y < 0 || width <= 0 || height <= 0 {
+		abortUserError("Bad crop, position must not be negative and size must be positive.")
+	}
+	return img.with(fmt.Sprintf("crop %d,%d %dx%d", x, y, width, height), func(m imagelib.Image) imagelib.Image {
+		b := m.Bounds()
+		r := imagelib.Rect(x, y, x+width, y+height).Add(b.Min).Intersect(b)
+		if r.Empty() {
+			abortUserError("Crop is outside the image.")
+		}
+		n := imagelib.NewRGBA(imagelib.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(n, n.Bounds(), m, r.Min, draw.Src)
+		return n
+	})
+}
+
+// rotate turns img clockwise by degrees, a multiple of 90.
+func rotate(degrees int, img *Img) *Img {
+	if degrees%90 != 0 {
+		abortUserError("Bad rotation, must be a multiple of 90 degrees.")
+	}
+	turns := (degrees/90%4 + 4) % 4
+	if turns == 0 {
+		return img
+	}
+	// Rotating clockwise is what the EXIF orientations 6, 3 and 8 require.
+	o := []int{1, 6, 3, 8}[turns]
+	return img.with(fmt.Sprintf("rotate %d", turns*90), func(m imagelib.Image) imagelib.Image {
+		return orient(m, o)
+	})
+}
+
+// grayscale removes the colors from img, keeping transparency.
+func grayscale(img *Img) *Img {
+	return img.with("grayscale", func(m imagelib.Image) imagelib.Image {
+		b := m.Bounds()
+		n := imagelib.NewNRGBA(imagelib.Rect(0, 0, b.Dx(), b.Dy()))
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+				g := color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.Gray).Y
+				n.SetNRGBA(x-b.Min.X, y-b.Min.Y, color.NRGBA{g, g, g, c.A})
+			}
+		}
+		return n
+	})
+}
+
+// figure returns html for an image in a figure, with the alt text of the image
+// and its title as caption.
+func figure(o interface{}) template.HTML {
+	return figureImage(o, inlineImage)
+}
+
+// figureImage is like figure, with the image source from inline.
+func figureImage(o interface{}, inline func(interface{}) template.URL) template.HTML {
+	var source *image
+	switch img := o.(type) {
+	case *Img:
+		source = img.source
+	case *image:
+		source = img
+	default:
+		abortUserError(fmt.Sprintf("Unexpected input %T to figure.", o))
+	}
+	var alt, title string
+	if source != nil {
+		alt, title = source.Alt, source.Title
+	}
+	s := fmt.Sprintf(`<figure><img src="%s" alt="%s" />`, html.EscapeString(string(inline(o))), html.EscapeString(alt))
+	if title != "" {
+		s += fmt.Sprintf(`<figcaption>%s</figcaption>`, html.EscapeString(title))
+	}
+	return template.HTML(s + "</figure>")
+}
+
+// imageFileType returns the mimetype and the extension for the data file of
+// an image, based on the extension of the uploaded file name. The mimetype is
+// empty if the file type is not supported.
+func imageFileType(filename string) (mimetype, ext string) {
+	switch strings.ToLower(filename[strings.LastIndex(filename, ".")+1:]) {
+	case "jpg", "jpeg":
+		return "image/jpeg", "jpg"
+	case "png":
+		return "image/png", "png"
+	case "gif":
+		return "image/gif", "gif"
+	case "mp4":
+		return "video/mp4", "mp4"
 	}
+	return "", ""
 }
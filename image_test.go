@@ -0,0 +1,85 @@
+package main
+
+import (
+	"html/template"
+	imagelib "image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestImageFilters(t *testing.T) {
+	// 3x2 image, with red at top left and transparent at bottom right.
+	m := imagelib.NewNRGBA(imagelib.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{0, 0, 255, 255})
+		}
+	}
+	m.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	m.SetNRGBA(2, 1, color.NRGBA{0, 0, 0, 0})
+	img := &Img{base: m, format: "png"}
+
+	pixel := func(img *Img, x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.image().At(x, y)).(color.NRGBA)
+	}
+	size := func(name string, img *Img, w, h int) {
+		t.Helper()
+		if dx, dy := img.size(); dx != w || dy != h {
+			t.Fatalf("%s: size %dx%d, expected %dx%d", name, dx, dy, w, h)
+		}
+	}
+	red := color.NRGBA{255, 0, 0, 255}
+
+	r := rotate(90, img)
+	size("rotate 90", r, 2, 3)
+	if c := pixel(r, 1, 0); c != red {
+		t.Fatalf("rotate 90: top right %v, expected red", c)
+	}
+	r = rotate(-90, img)
+	if c := pixel(r, 0, 2); c != red {
+		t.Fatalf("rotate -90: bottom left %v, expected red", c)
+	}
+	if r := rotate(360, img); r != img {
+		t.Fatalf("rotate 360 changed image")
+	}
+
+	c := crop(1, 1, 5, 5, img)
+	size("crop", c, 2, 1)
+	if p := pixel(c, 1, 0); p.A != 0 {
+		t.Fatalf("crop: got %v, expected transparent", p)
+	}
+
+	g := grayscale(img)
+	if p := pixel(g, 0, 0); p.R != p.G || p.G != p.B || p.A != 255 {
+		t.Fatalf("grayscale: got %v", p)
+	}
+	if p := pixel(g, 2, 1); p.A != 0 {
+		t.Fatalf("grayscale: got %v, expected transparent", p)
+	}
+
+	j := toJPEG("#fff", img)
+	if j.format != "jpeg" {
+		t.Fatalf("toJPEG: format %q", j.format)
+	}
+	if p := pixel(j, 2, 1); p != (color.NRGBA{255, 255, 255, 255}) {
+		t.Fatalf("toJPEG: transparent pixel %v, expected white", p)
+	}
+	if p := toPNG(j); p.format != "png" || j.format != "jpeg" {
+		t.Fatalf("toPNG: formats %q and %q", p.format, j.format)
+	}
+
+	if _, err := parseColor("#12345"); err == nil {
+		t.Fatalf("parseColor accepted bad color")
+	}
+
+	src := &image{Slug: "x", Title: "A <title>", Alt: `"alt"`}
+	s := string(figureImage(src, func(interface{}) template.URL { return "data:," }))
+	exp := `<figure><img src="data:," alt="&#34;alt&#34;" /><figcaption>A &lt;title&gt;</figcaption></figure>`
+	if s != exp {
+		t.Fatalf("figure: got %q, expected %q", s, exp)
+	}
+	if s := string(figureImage(&image{}, func(interface{}) template.URL { return "" })); strings.Contains(s, "figcaption") {
+		t.Fatalf("figure without title has caption: %q", s)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The image cache holds the results of operations on images, like scaled
+// thumbnails, encoded as jpeg or png. Files are stored in data/cache/ by the
+// hash of their key, which has the ID of the source image, the operations, the
+// format and the quality. Images are never changed, so entries do not need
+// invalidation. When the cache grows beyond its maximum size, the least
+// recently used files are removed. The cache is not part of backups.
+
+var (
+	metricImageCacheHit = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blogx_image_cache_hit_total",
+		Help: "Number of images read from the image cache.",
+	})
+	metricImageCacheMiss = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blogx_image_cache_miss_total",
+		Help: "Number of images generated because they were not in the image cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricImageCacheHit, metricImageCacheMiss)
+}
+
+var imageCache = &diskCache{dir: "data/cache", size: -1}
+
+type diskCache struct {
+	dir string
+
+	sync.Mutex
+	size int64 // Total size of the files in the cache, -1 until known.
+}
+
+// maxImageCacheSize returns the maximum size of the image cache in bytes.
+func maxImageCacheSize() int64 {
+	n := config.ImageCacheSize
+	if n <= 0 {
+		n = 256
+	}
+	return int64(n) * 1024 * 1024
+}
+
+// get returns the data for key from the cache, or generates and stores it if
+// absent. The extension is used for the file name.
+func (c *diskCache) get(key, ext string, gen func() []byte) []byte {
+	h := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	path := filepath.Join(c.dir, h[:2], h+"."+ext)
+	if buf, err := os.ReadFile(path); err == nil {
+		metricImageCacheHit.Inc()
+		// The modification time is the last use, for eviction.
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return buf
+	}
+
+	metricImageCacheMiss.Inc()
+	buf := gen()
+	if err := writeFileAtomic(path, buf); err != nil {
+		log.Printf("writing to image cache: %v", err)
+		return buf
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.size < 0 {
+		// Includes the file we just wrote.
+		c.size = c.evict(-1)
+	} else {
+		c.size += int64(len(buf))
+	}
+	if max := maxImageCacheSize(); c.size > max {
+		c.size = c.evict(max * 9 / 10)
+	}
+	return buf
+}
+
+// evict removes the least recently used files until the cache is at most
+// target bytes, and returns the resulting size. With negative target, only
+// the size is calculated. Must be called with c locked.
+func (c *diskCache) evict(target int64) int64 {
+	type entry struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var l []entry
+	var size int64
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		l = append(l, entry{path, fi.Size(), fi.ModTime()})
+		size += fi.Size()
+		return nil
+	})
+	if target < 0 {
+		return size
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].mtime.Before(l[j].mtime)
+	})
+	for _, e := range l {
+		if size <= target {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			log.Printf("removing from image cache: %v", err)
+			continue
+		}
+		size -= e.size
+	}
+	return size
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	c := &diskCache{dir: t.TempDir(), size: -1}
+
+	var generated int
+	gen := func(s string) func() []byte {
+		return func() []byte {
+			generated++
+			return []byte(s)
+		}
+	}
+	if buf := c.get("a", "png", gen("aaaa")); string(buf) != "aaaa" || generated != 1 {
+		t.Fatalf("get: got %q, generated %d, expected %q, 1", buf, generated, "aaaa")
+	}
+	if buf := c.get("a", "png", gen("xxxx")); string(buf) != "aaaa" || generated != 1 {
+		t.Fatalf("get cached: got %q, generated %d, expected %q, 1", buf, generated, "aaaa")
+	}
+	c.get("b", "png", gen("bbbb"))
+	c.get("c", "png", gen("cccc"))
+	if c.size != 12 {
+		t.Fatalf("size %d, expected 12", c.size)
+	}
+
+	// Make "b" the least recently used, and "a" the most.
+	files := map[string]string{}
+	filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			buf, _ := os.ReadFile(path)
+			files[string(buf)] = path
+		}
+		return nil
+	})
+	now := time.Now()
+	os.Chtimes(files["bbbb"], now.Add(-3*time.Hour), now.Add(-3*time.Hour))
+	os.Chtimes(files["cccc"], now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	os.Chtimes(files["aaaa"], now.Add(-time.Hour), now.Add(-time.Hour))
+	c.get("a", "png", gen("xxxx"))
+
+	if size := c.evict(8); size != 8 {
+		t.Fatalf("evict: size %d, expected 8", size)
+	}
+	if _, err := os.Stat(files["bbbb"]); !os.IsNotExist(err) {
+		t.Fatalf("least recently used file not evicted: %v", err)
+	}
+	for _, s := range []string{"aaaa", "cccc"} {
+		if _, err := os.Stat(files[s]); err != nil {
+			t.Fatalf("file %s evicted: %v", s, err)
+		}
+	}
+}
+
+func TestDiskCacheDataStamp(t *testing.T) {
+	testDataDir(t)
+
+	// Writes to and hits in the image cache must not look like data changes, they
+	// would drop all cached pages.
+	stamp, err := dataStamp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &diskCache{dir: "data/cache", size: -1}
+	c.get("a", "png", func() []byte { return []byte("aaaa") })
+	time.Sleep(10 * time.Millisecond)
+	c.get("a", "png", func() []byte { return []byte("aaaa") })
+	if s, err := dataStamp(); err != nil || s != stamp {
+		t.Fatalf("data stamp changed after image cache write: %v", err)
+	}
+}
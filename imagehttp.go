@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Images are served at <baseurl>i/<slug>, so they can be linked to. With
+// parameter w, the image is scaled down to that width. These variants are kept
+// in the image cache. To limit the work anyone can cause by requesting
+// arbitrary sizes, the width is rounded up to one of imageWidths. Pages show
+// images at their size with width and height attributes.
+
+// imageWidths are the widths images are scaled down to.
+var imageWidths = []uint{160, 320, 480, 640, 800, 1024, 1280, 1600, 2048}
+
+// snapWidth returns the width from imageWidths to scale an image of width dx
+// down to, for showing it at width. Zero means the original size.
+func snapWidth(dx, width uint) uint {
+	for _, sw := range imageWidths {
+		if sw >= width {
+			if sw >= dx {
+				return 0
+			}
+			return sw
+		}
+	}
+	return 0
+}
+
+func imageURL(slug string) string {
+	return config.BaseURL + "i/" + url.PathEscape(slug)
+}
+
+// imageVariantURL returns the URL of the image scaled down for showing it at
+// width, as returned by fitSize. The URL has the width rounded up like the
+// server does, so the same variant always has the same URL.
+func imageVariantURL(slug string, width uint) string {
+	for _, sw := range imageWidths {
+		if sw >= width {
+			return fmt.Sprintf("%s?w=%d", imageURL(slug), sw)
+		}
+	}
+	return imageURL(slug)
+}
+
+// fitSize returns the size of an image of dx by dy scaled down to fit within
+// width and height, keeping the aspect ratio. Zero width or height is no limit.
+// Images are not scaled up.
+func fitSize(dx, dy, width, height uint) (uint, uint) {
+	if width == 0 || width > dx {
+		width = dx
+	}
+	if height == 0 || height > dy {
+		height = dy
+	}
+	if dx*height > dy*width {
+		height = max(1, dy*width/dx)
+	} else {
+		width = max(1, dx*height/dy)
+	}
+	return width, height
+}
+
+// imageVariant returns the data of img scaled down to width, rounded up by
+// snapWidth. The original data is returned for images that are already small
+// enough and for formats that cannot be scaled.
+func imageVariant(img *image, width uint) []byte {
+	if width == 0 || img.Mimetype != "image/jpeg" && img.Mimetype != "image/png" {
+		buf, err := img.Data()
+		httpCheck(err)
+		return buf
+	}
+	x := image2img(img)
+	dx, dy := x.size()
+	width = snapWidth(uint(dx), width)
+	if width == 0 {
+		buf, err := img.Data()
+		httpCheck(err)
+		return buf
+	}
+	buf, _ := thumbnail(width, uint(dy), x).encode()
+	return buf
+}
+
+// publicImage serves an image by its slug, optionally scaled down.
+func publicImage(w http.ResponseWriter, r *http.Request) {
+	needGet(r)
+	slug := strings.TrimPrefix(r.URL.Path, "i/")
+	data, err := loadStore()
+	httpCheck(err)
+	img := data.findImageBySlug(slug)
+	if img == nil {
+		abort(404)
+	}
+	if img.isVideo() {
+		serveVideo(w, r, img)
+		return
+	}
+
+	var width uint
+	if s := r.URL.Query().Get("w"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil || n == 0 {
+			abortUserError("Bad parameter w, must be a positive number.")
+		}
+		width = uint(n)
+	}
+
+	buf := imageVariant(img, width)
+	h := sha256.Sum256(buf)
+	w.Header().Set("Content-Type", img.Mimetype)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, h[:16]))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", img.Time, bytes.NewReader(buf))
+}
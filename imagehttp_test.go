@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	imagelib "image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestImageVariant(t *testing.T) {
+	testDataDir(t)
+
+	test := func(dx, width, exp uint) {
+		t.Helper()
+		if w := snapWidth(dx, width); w != exp {
+			t.Fatalf("snapWidth %d to %d: got %d, expected %d", dx, width, w, exp)
+		}
+	}
+	test(1000, 600, 640)
+	test(1000, 601, 640)
+	test(1000, 200, 320)
+	test(1000, 1, 160)
+	test(1000, 900, 0)
+	test(1000, 65535, 0)
+	test(3000, 2500, 0)
+
+	if s := imageVariantURL("cat", 601); s != "https://example.org/i/cat?w=640" {
+		t.Fatalf("imageVariantURL: got %q", s)
+	}
+	if s := imageVariantURL("cat", 3000); s != "https://example.org/i/cat" {
+		t.Fatalf("imageVariantURL: got %q", s)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, imagelib.NewNRGBA(imagelib.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+	img := &image{ID: "x", Slug: "cat", Mimetype: "image/png", Filename: "data.png", Time: time.Now()}
+	if err := writeImageData(img, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	size := func(width uint, exp int) {
+		t.Helper()
+		m, err := png.DecodeConfig(bytes.NewReader(imageVariant(img, width)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Width != exp || m.Height != exp/2 {
+			t.Fatalf("imageVariant %d: got %dx%d, expected width %d", width, m.Width, m.Height, exp)
+		}
+	}
+	size(601, 640)
+	size(599, 640)
+	size(50, 160)
+	size(999, 1000)
+	size(0, 1000)
+}
@@ -10,7 +10,6 @@ import (
 	"embed"
 	"flag"
 	"html/template"
-	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
@@ -32,13 +31,17 @@ var (
 var fsys embed.FS
 
 var config struct {
-	Password      string
-	BaseURL       string
-	CookieAuthKey string
-	BlogTitle     string
-	BlogAuthor    string
-	SecureCookies bool
-	Mail          struct {
+	Password       string
+	BaseURL        string
+	CookieAuthKey  string
+	BlogTitle      string
+	BlogAuthor     string
+	SecureCookies  bool
+	SummaryLength  int    `sconf:"optional" sconf-doc:"Length in characters of the automatic summary of posts on the index page and in feeds, for posts without summary and without <!--more--> marker. Default 275."`
+	ImageCacheSize int    `sconf:"optional" sconf-doc:"Maximum size in megabytes of the cache of scaled images in data/cache/. Default 256."`
+	PageBudget     int    `sconf:"optional" sconf-doc:"Maximum number of bytes of images inlined in a post or page. Further images get a small inlined placeholder and are loaded separately. Posts can override the budget. Default 0, for no limit."`
+	ThemeDir       string `sconf:"optional" sconf-doc:"Directory with templates and static files overriding the defaults compiled into blogx, with the same paths, e.g. t/post.html and s/css/style.css. Create one with blogx theme-init."`
+	Mail           struct {
 		Host     string `sconf:"Host of submission/smtp server."`
 		Port     int    `sconf:"Port of submission/smtp server, e.g. 465 for submissions, 587 for submission, 25 for smtp."`
 		TLS      bool   `sconf:"Dial with TLS, for submissions on port 465."`
@@ -48,13 +51,18 @@ var config struct {
 		From     string `sconf:"SMTP and message From."`
 		To       string `sconf:"SMTP and message To."`
 	} `sconf:"optional" sconf-doc:"Send email notifications about new potentially spammy comments with this configuration."`
+	Backup struct {
+		Dir      string `sconf:"optional" sconf-doc:"Directory for backups made through the admin pages, default backup."`
+		Keep     int    `sconf:"optional" sconf-doc:"Number of newest backups to keep, default 7."`
+		KeepDays int    `sconf:"optional" sconf-doc:"Also keep the newest backup of each day for this many days, default 30."`
+	} `sconf:"optional" sconf-doc:"Backups of the data directory made through the admin pages."`
 }
 
 func main() {
 	log.SetFlags(0)
 
 	if len(os.Args) < 2 {
-		log.Println("usage: blogx { config-test | config-describe | serve | version }")
+		log.Println("usage: blogx { config-test | config-describe | serve | migrate | export | import | import-wxr | fsck | backup | restore | theme-init | version }")
 		os.Exit(2)
 	}
 
@@ -75,6 +83,22 @@ func main() {
 		check(err, "describing config file")
 	case "serve":
 		serve(args)
+	case "migrate":
+		migrate(args)
+	case "export":
+		exportArchive(args)
+	case "import":
+		importArchive(args)
+	case "import-wxr":
+		importWXR(args)
+	case "fsck":
+		fsck(args)
+	case "backup":
+		backup(args)
+	case "restore":
+		restore(args)
+	case "theme-init":
+		themeInit(args)
 	case "version":
 		log.Printf("version %s", version)
 	default:
@@ -104,20 +128,22 @@ func serve(args []string) {
 	baseURL, err = url.Parse(config.BaseURL)
 	check(err, "parsing baseURL in config file")
 
+	storeChanged()
+	go watchStore()
+	go publishScheduled()
+
 	stripBase := func(fn http.Handler) http.Handler {
 		return http.StripPrefix(baseURL.Path, fn)
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
 
-	sfs, err := fs.Sub(fsys, "assets")
-	if err != nil {
-		log.Fatalf("fsys sub: %v", err)
-	}
-
 	mux := http.NewServeMux()
-	mux.Handle(baseURL.Path+"s/", stripBase(http.FileServer(http.FS(sfs))))
+	mux.Handle(baseURL.Path+"s/", stripBase(http.FileServer(http.FS(assetFS()))))
 	mux.Handle(baseURL.Path+"p/", handleHTTPError(stripBase(http.HandlerFunc(publicPost))))
+	mux.Handle(baseURL.Path+"t/", handleHTTPError(stripBase(http.HandlerFunc(publicTag))))
+	mux.Handle(baseURL.Path+"i/", handleHTTPError(stripBase(http.HandlerFunc(publicImage))))
+	mux.Handle(baseURL.Path+"v/", handleHTTPError(stripBase(http.HandlerFunc(publicVideo))))
 	mux.Handle(baseURL.Path+"a/", handleHTTPError(stripBase(http.HandlerFunc(admin))))
 	mux.Handle(baseURL.Path+"feed.atom", handleHTTPError(stripBase(http.HandlerFunc(atomFeed))))
 	mux.Handle(baseURL.Path, handleHTTPError(stripBase(http.HandlerFunc(index))))
@@ -2,28 +2,174 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
 
 	"github.com/russross/blackfriday"
+	xhtml "golang.org/x/net/html"
 )
 
+// tocMarker in a post body is replaced by a table of contents of the headings.
+const tocMarker = "<!--toc-->"
+
 type headerHTMLRenderer struct {
 	*blackfriday.Html
+
+	ids      map[string]bool // Heading IDs in use, to make them unique.
+	headings []heading
+
+	data      *store // For image: and post: references, loaded when first needed.
+	checkOnly bool   // Only check references, don't inline images.
+	refErrors []string
+	budget    *imageBudget // For images inlined from image: references.
+
+	// If set, called with text as it is rendered, in document order.
+	textHook func(text []byte)
 }
 
+type heading struct {
+	Level int
+	ID    string
+	Text  string
+}
+
+// Header writes headings one level lower than in the markdown, so the post
+// title can be the only h1. Each heading gets a unique id, from {#id} in the
+// markdown or from its text, and a link to itself.
 func (r *headerHTMLRenderer) Header(out *bytes.Buffer, text func() bool, level int, id string) {
-	r.Html.Header(out, text, level+1, id)
+	marker := out.Len()
+	if !text() {
+		out.Truncate(marker)
+		return
+	}
+	inner := string(out.Bytes()[marker:])
+	out.Truncate(marker)
+
+	level++
+	plain := htmlText(inner)
+	if id == "" {
+		id = headingID(plain)
+	}
+	id = r.uniqueID(id)
+	r.headings = append(r.headings, heading{level, id, plain})
+
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	fmt.Fprintf(out, `<h%d id="%s">%s <a class="anchor" href="#%s" title="Link to this section">#</a></h%d>`+"\n", level, html.EscapeString(id), inner, html.EscapeString(id), level)
+}
+
+// BlockCode highlights code in fenced blocks for known languages.
+func (r *headerHTMLRenderer) BlockCode(out *bytes.Buffer, text []byte, info string) {
+	lang, _, _ := strings.Cut(strings.TrimSpace(info), " ")
+	hl, ok := highlight(lang, string(text))
+	if !ok {
+		r.Html.BlockCode(out, text, info)
+		return
+	}
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	fmt.Fprintf(out, `<pre><code class="language-%s">%s</code></pre>`+"\n", html.EscapeString(lang), hl)
+}
+
+func (r *headerHTMLRenderer) NormalText(out *bytes.Buffer, text []byte) {
+	if r.textHook != nil {
+		r.textHook(text)
+	}
+	r.Html.NormalText(out, text)
+}
+
+func (r *headerHTMLRenderer) uniqueID(id string) string {
+	xid := id
+	for i := 2; r.ids[xid]; i++ {
+		xid = fmt.Sprintf("%s-%d", id, i)
+	}
+	r.ids[xid] = true
+	return xid
+}
+
+// headingID returns an id for a heading with text s: lower case words joined with dashes.
+func headingID(s string) string {
+	f := func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}
+	id := strings.Join(strings.FieldsFunc(strings.ToLower(s), f), "-")
+	if id == "" {
+		id = "section"
+	}
+	return id
+}
+
+// htmlText returns the text in html fragment s, without tags.
+func htmlText(s string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case xhtml.TextToken:
+			b.Write(z.Text())
+		}
+	}
+}
+
+// toc returns a table of contents as nested lists, for headings in document order.
+func toc(headings []heading) string {
+	if len(headings) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`<nav class="toc">`)
+	var levels []int // Levels of open lists.
+	for _, h := range headings {
+		for len(levels) > 0 && h.Level < levels[len(levels)-1] {
+			b.WriteString("</li></ul>")
+			levels = levels[:len(levels)-1]
+		}
+		if len(levels) == 0 || h.Level > levels[len(levels)-1] {
+			b.WriteString("<ul>")
+			levels = append(levels, h.Level)
+		} else {
+			b.WriteString("</li>")
+		}
+		fmt.Fprintf(&b, `<li><a href="#%s">%s</a>`, html.EscapeString(h.ID), html.EscapeString(h.Text))
+	}
+	for range levels {
+		b.WriteString("</li></ul>")
+	}
+	b.WriteString("</nav>")
+	return b.String()
 }
 
 // just like in blackfriday's Markdown func
 func headerMarkdown(in []byte) []byte {
+	return newHeaderHTMLRenderer().markdown(in)
+}
+
+func newHeaderHTMLRenderer() *headerHTMLRenderer {
 	// set up the HTML renderer
 	htmlFlags := 0
 	htmlFlags |= blackfriday.HTML_USE_XHTML
 	htmlFlags |= blackfriday.HTML_USE_SMARTYPANTS
 	htmlFlags |= blackfriday.HTML_SMARTYPANTS_FRACTIONS
 	htmlFlags |= blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
-	renderer := &headerHTMLRenderer{blackfriday.HtmlRenderer(htmlFlags, "", "").(*blackfriday.Html)}
+	return &headerHTMLRenderer{Html: blackfriday.HtmlRenderer(htmlFlags, "", "").(*blackfriday.Html), ids: map[string]bool{}}
+}
+
+func (r *headerHTMLRenderer) markdown(in []byte) []byte {
+	out := r.render(in)
+	if bytes.Contains(out, []byte(tocMarker)) {
+		out = bytes.ReplaceAll(out, []byte(tocMarker), []byte(toc(r.headings)))
+	}
+	return out
+}
 
+// render renders markdown in to html, without replacing tocMarker.
+func (r *headerHTMLRenderer) render(in []byte) []byte {
 	// set up the parser
 	extensions := 0
 	extensions |= blackfriday.EXTENSION_NO_INTRA_EMPHASIS
@@ -34,5 +180,5 @@ func headerMarkdown(in []byte) []byte {
 	extensions |= blackfriday.EXTENSION_SPACE_HEADERS
 	extensions |= blackfriday.EXTENSION_HEADER_IDS
 
-	return blackfriday.Markdown(in, renderer, extensions)
+	return blackfriday.Markdown(in, r, extensions)
 }
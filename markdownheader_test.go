@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderMarkdown(t *testing.T) {
+	test := func(md string, exps ...string) {
+		t.Helper()
+		r := string(headerMarkdown([]byte(md)))
+		for _, exp := range exps {
+			if !strings.Contains(r, exp) {
+				t.Fatalf("headerMarkdown %q: got %q, expected it to contain %q", md, r, exp)
+			}
+		}
+	}
+
+	test("# Intro\n", `<h2 id="intro">Intro <a class="anchor" href="#intro"`)
+	test("# Intro\n\n## Intro\n", `id="intro"`, `<h3 id="intro-2">`)
+	test("# Über *alles*, ok?\n", `<h2 id="über-alles-ok">Über <em>alles</em>, ok?`)
+	test("# Named {#x}\n\n# x\n", `<h2 id="x">`, `<h2 id="x-2">`)
+	test("# !!\n", `<h2 id="section">`)
+	test("<!--toc-->\n\n# A\n\n## B\n\n# C\n", `<nav class="toc"><ul><li><a href="#a">A</a><ul><li><a href="#b">B</a></li></ul></li><li><a href="#c">C</a></li></ul></nav>`)
+	test("<!--toc-->\n\n## B\n\n# A & b\n", `<nav class="toc"><ul><li><a href="#b">B</a></li></ul><ul><li><a href="#a-b">A &amp; b</a></li></ul></nav>`)
+}
+
+func TestCheckMarkdownRefs(t *testing.T) {
+	data := &store{
+		Posts: []*post{
+			{Slug: "hello", OldSlugs: []string{"hi"}, Active: true},
+			{Slug: "draft"},
+			{Slug: "later", Active: true, Publish: time.Now().Add(time.Hour)},
+		},
+		Images: []*image{{Slug: "cat"}},
+	}
+	test := func(md, exp string) {
+		t.Helper()
+		err := checkMarkdownRefs(data, md)
+		var s string
+		if err != nil {
+			s = err.Error()
+		}
+		if s != exp {
+			t.Fatalf("checkMarkdownRefs %q: got error %q, expected %q", md, s, exp)
+		}
+	}
+
+	test("![a](image:cat?w=600&h=400) [x](post:hello) [y](post:hi#top) [z](https://example.org/)", "")
+	test("`![a](image:dog)`\n\n    [x](post:nope)\n", "")
+	test("![a](image:dog)", `image "dog" does not exist`)
+	test("[x](post:nope)", `post "nope" does not exist`)
+	test("[x](post:draft) [y](post:later)", `post "draft" is not published; post "later" is not published`)
+	test("![a](image:cat?w=x)", `image "cat": invalid w "x", must be a positive number`)
+	test("![a](image:cat?q=1)", `image "cat": unknown parameter "q"`)
+}
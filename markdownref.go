@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Markdown in posts and pages can reference images and posts by slug:
+//
+//	![alt](image:slug?w=600&h=400)
+//	[text](post:slug#section)
+//
+// Images are inlined, scaled down to fit the optional maximum width and height,
+// and link to the original image.
+// Links to posts get the URL of the post, also when the post was renamed and
+// slug is an old slug. Links to posts that are not published are left out.
+
+// markdownRef returns the parsed link if it has scheme, e.g. "image" for image:slug.
+func markdownRef(link []byte, scheme string) (*url.URL, bool) {
+	if !bytes.HasPrefix(link, []byte(scheme+":")) {
+		return nil, false
+	}
+	u, err := url.Parse(string(link))
+	if err != nil || u.Scheme != scheme || u.Opaque == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+func (r *headerHTMLRenderer) loadData() *store {
+	if r.data == nil {
+		data, err := loadStore()
+		httpCheck(err)
+		r.data = data
+	}
+	return r.data
+}
+
+func (r *headerHTMLRenderer) refErrorf(format string, args ...interface{}) {
+	r.refErrors = append(r.refErrors, fmt.Sprintf(format, args...))
+}
+
+// Image inlines images referenced as image:slug.
+func (r *headerHTMLRenderer) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+	u, ok := markdownRef(link, "image")
+	if !ok {
+		r.Html.Image(out, link, title, alt)
+		return
+	}
+	slug := u.Opaque
+	img := r.loadData().findImageBySlug(slug)
+	if img == nil {
+		r.refErrorf("image %q does not exist", slug)
+		out.WriteString(html.EscapeString(string(alt)))
+		return
+	}
+	var width, height uint
+	for k, l := range u.Query() {
+		var v *uint
+		switch k {
+		case "w":
+			v = &width
+		case "h":
+			v = &height
+		default:
+			r.refErrorf("image %q: unknown parameter %q", slug, k)
+			continue
+		}
+		n, ok := parseImageDimension(l[0])
+		if !ok {
+			r.refErrorf("image %q: invalid %s %q, must be a positive number", slug, k, l[0])
+			continue
+		}
+		*v = n
+	}
+	if len(alt) == 0 {
+		alt = []byte(img.Alt)
+	}
+	if r.checkOnly {
+		r.Html.Image(out, link, title, alt)
+		return
+	}
+	writeImageRef(out, img, width, height, title, alt, r.budget)
+}
+
+// parseImageDimension parses the value of a w or h parameter for an image.
+func parseImageDimension(s string) (uint, bool) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint(n), err == nil && n > 0
+}
+
+// writeImageRef writes an img tag for img linking to the original. The image is
+// inlined, scaled down to fit within width and height if non-zero, if it fits in
+// budget, and loaded from the image endpoint otherwise.
+func writeImageRef(out *bytes.Buffer, img *image, width, height uint, title, alt []byte, budget *imageBudget) {
+	fmt.Fprintf(out, `<a class="image" href="%s">`, html.EscapeString(imageURL(img.Slug)))
+	inlined := false
+	if !budget.exhausted() {
+		if src := inlineImageRef(img, width, height); budget.take(len(src)) {
+			fmt.Fprintf(out, `<img src="%s" alt="%s"`, html.EscapeString(src), html.EscapeString(string(alt)))
+			if len(title) > 0 {
+				fmt.Fprintf(out, ` title="%s"`, html.EscapeString(string(title)))
+			}
+			out.WriteString(" />")
+			inlined = true
+		}
+	}
+	if !inlined {
+		writeExternalImage(out, img, width, height, title, alt)
+	}
+	out.WriteString("</a>")
+}
+
+// inlineImageRef returns a data URL for img, scaled down to fit within width
+// and height if they are non-zero. Images are not scaled up.
+func inlineImageRef(img *image, width, height uint) string {
+	if width == 0 && height == 0 || img.Mimetype != "image/jpeg" && img.Mimetype != "image/png" {
+		return string(inlineImage(img))
+	}
+	x := image2img(img)
+	xdx, xdy := x.size()
+	dx, dy := uint(xdx), uint(xdy)
+	if width == 0 {
+		width = dx
+	}
+	if height == 0 {
+		height = dy
+	}
+	if width >= dx && height >= dy {
+		return string(inlineImage(img))
+	}
+	return string(inlineImage(thumbnail(width, height, x)))
+}
+
+// imageLinkRegexp matches the link around an image referenced as image:slug.
+var imageLinkRegexp = regexp.MustCompile(`<a class="image" href="[^"]*">(.*?)</a>`)
+
+// Link resolves links to posts referenced as post:slug.
+func (r *headerHTMLRenderer) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	// Images in the link text link to the target of this link, not to themselves.
+	content = imageLinkRegexp.ReplaceAll(content, []byte("$1"))
+
+	u, ok := markdownRef(link, "post")
+	if !ok {
+		r.Html.Link(out, link, title, content)
+		return
+	}
+	data := r.loadData()
+	p := data.findPostBySlug(u.Opaque)
+	if p == nil {
+		p = data.findPostByOldSlug(u.Opaque)
+	}
+	if p == nil {
+		r.refErrorf("post %q does not exist", u.Opaque)
+		out.Write(content)
+		return
+	}
+	if !p.Published(time.Now()) {
+		// Linking would expose the slug of a draft, and lead to a 404.
+		r.refErrorf("post %q is not published", u.Opaque)
+		out.Write(content)
+		return
+	}
+	if r.checkOnly {
+		r.Html.Link(out, link, title, content)
+		return
+	}
+	href := slug2url(p.Slug)
+	if u.Fragment != "" {
+		href += "#" + u.EscapedFragment()
+	}
+	r.Html.Link(out, []byte(href), title, content)
+}
+
+// checkMarkdownRefs returns an error if markdown md references images or posts
+// that are not in data, or has invalid image parameters.
+func checkMarkdownRefs(data *store, md string) error {
+	r := newHeaderHTMLRenderer()
+	r.data = data
+	r.checkOnly = true
+	r.markdown([]byte(md))
+	if len(r.refErrors) > 0 {
+		return errors.New(strings.Join(r.refErrors, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// migrateFile is a file in the data directory that can be rewritten in the
+// current format.
+type migrateFile struct {
+	path    string
+	marshal func() ([]byte, error) // Parses the file and returns it in the current format.
+}
+
+func migrate(args []string) {
+	fl := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryrun := fl.Bool("dryrun", false, "Only report which files would be rewritten")
+	fl.Usage = func() {
+		log.Printf("usage: blogx migrate [-dryrun]")
+		log.Printf("Rewrites files in the data directory in the current directory to the v2 format. Stop blogx serve first.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	if fl.NArg() != 0 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	files, err := migrateFiles()
+	check(err, "listing data files")
+
+	var nmigrate, ncurrent, nerrors int
+	for _, f := range files {
+		version, err := fileVersion(f.path)
+		if err != nil {
+			log.Printf("%s: %v", f.path, err)
+			nerrors++
+			continue
+		}
+		if version == "v2" {
+			ncurrent++
+			continue
+		}
+		buf, err := f.marshal()
+		if err != nil {
+			log.Printf("%v", err)
+			nerrors++
+			continue
+		}
+		if *dryrun {
+			log.Printf("%s: would rewrite from %s to v2", f.path, version)
+		} else if err := writeFileAtomic(f.path, buf); err != nil {
+			log.Printf("%s: writing: %v", f.path, err)
+			nerrors++
+			continue
+		} else {
+			log.Printf("%s: rewritten from %s to v2", f.path, version)
+		}
+		nmigrate++
+	}
+	if *dryrun {
+		log.Printf("%d files would be rewritten, %d already v2, %d errors", nmigrate, ncurrent, nerrors)
+	} else {
+		log.Printf("%d files rewritten, %d already v2, %d errors", nmigrate, ncurrent, nerrors)
+	}
+	if nerrors > 0 {
+		os.Exit(1)
+	}
+}
+
+// migrateFiles lists the posts, revisions, comments and images in the data directory.
+func migrateFiles() ([]migrateFile, error) {
+	var files []migrateFile
+
+	postIDs, err := listDir("data/post")
+	if err != nil {
+		return nil, err
+	}
+	for _, postID := range postIDs {
+		path := fmt.Sprintf("data/post/%s/post.txt", postID)
+		files = append(files, migratePostFile(path, postID))
+
+		revs, err := listDir(fmt.Sprintf("data/post/%s/revisions", postID))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, name := range revs {
+			if !strings.HasSuffix(name, ".txt") {
+				continue
+			}
+			files = append(files, migratePostFile(fmt.Sprintf("data/post/%s/revisions/%s", postID, name), postID))
+		}
+
+		comments, err := listDir(fmt.Sprintf("data/post/%s/comment", postID))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, name := range comments {
+			if !strings.HasSuffix(name, ".txt") {
+				continue
+			}
+			path := fmt.Sprintf("data/post/%s/comment/%s", postID, name)
+			commentID := strings.TrimSuffix(name, ".txt")
+			files = append(files, migrateFile{path, func() ([]byte, error) {
+				c, err := readComment(path, postID, commentID)
+				if err != nil {
+					return nil, err
+				}
+				return marshalComment(c)
+			}})
+		}
+	}
+
+	imageIDs, err := listDir("data/image")
+	if err != nil {
+		return nil, err
+	}
+	for _, imageID := range imageIDs {
+		path := fmt.Sprintf("data/image/%s/image.txt", imageID)
+		files = append(files, migrateFile{path, func() ([]byte, error) {
+			img, err := readImage(path, imageID)
+			if err != nil {
+				return nil, err
+			}
+			return marshalImage(img)
+		}})
+	}
+	return files, nil
+}
+
+func migratePostFile(path, postID string) migrateFile {
+	return migrateFile{path, func() ([]byte, error) {
+		p, err := readPost(path, postID)
+		if err != nil {
+			return nil, err
+		}
+		return marshalPost(p)
+	}}
+}
+
+// listDir returns the names in dir, skipping temporary files that start with a dot.
+func listDir(dir string) ([]string, error) {
+	l, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range l {
+		if !strings.HasPrefix(fi.Name(), ".") {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// fileVersion returns the first line of a data file, its format version.
+func fileVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("reading version: %v", err)
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
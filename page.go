@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pages are standalone pages like "About", outside the stream of posts. They
+// are served at <baseurl><slug>/, and are not in the index or feed. Pages with
+// a Menu position are linked from the navigation menu on all pages.
+type page struct {
+	ID      string
+	Active  bool
+	Slug    string
+	Title   string
+	Time    time.Time // Creation time.
+	Updated time.Time // Time of last save, zero if never saved after creation.
+	Menu    int       // Position in the navigation menu, lowest first. Zero for not in the menu.
+	// Execute body as template, like before shortcodes.
+	LegacyTemplates bool
+	Body            string
+}
+
+var pageSlugRegexp = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+
+// Paths under the base URL that cannot be page slugs.
+var reservedSlugs = map[string]bool{"a": true, "i": true, "p": true, "s": true, "t": true, "v": true}
+
+func checkPageSlug(slug string) error {
+	if !pageSlugRegexp.MatchString(slug) {
+		return fmt.Errorf("invalid slug %q for page, only letters, digits, dashes and underscores are allowed", slug)
+	}
+	if reservedSlugs[slug] {
+		return fmt.Errorf("slug %q for page is reserved", slug)
+	}
+	return nil
+}
+
+func page2url(slug string) string {
+	return fmt.Sprintf("%s%s/", baseURL.Path, slug)
+}
+
+// readPages reads the pages, data directories from before pages existed have no page directory.
+func (s *store) readPages(dir string) {
+	l, err := os.ReadDir(dir + "/page")
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.corrupt(fmt.Errorf("%s/page: listing pages: %s", dir, err))
+		}
+		return
+	}
+	for _, fi := range l {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		pg, err := readPage(dir+"/page/"+fi.Name()+"/page.txt", fi.Name())
+		if err != nil {
+			s.corrupt(err)
+			continue
+		}
+		s.Pages = append(s.Pages, pg)
+	}
+	sort.Slice(s.Pages, func(i, j int) bool {
+		return s.Pages[i].Title < s.Pages[j].Title
+	})
+}
+
+func readPage(filename string, id string) (pg *page, rerr error) {
+	pg = &page{ID: id}
+
+	p := &parser{filename: filename}
+	defer p.handle(&rerr)
+	f, err := os.Open(filename)
+	p.check(err, "open page file")
+	defer f.Close()
+
+	p.r = bufio.NewReader(f)
+
+	if v := p.Version(); v != "v2" {
+		p.errorf("got version %q, expected %q", v, "v2")
+	}
+	h := p.Header(true)
+	h.ID(pg.ID)
+	h.Bool("Status", &pg.Active, "inactive", "active")
+	h.Line("Slug", &pg.Slug)
+	h.Line("Title", &pg.Title)
+	h.Time("Time", &pg.Time)
+	h.OptTime("Updated", &pg.Updated)
+	h.OptInt("Menu", &pg.Menu)
+	h.Flag("Legacy-Templates", &pg.LegacyTemplates)
+	h.Done()
+	p.Rest(&pg.Body)
+	return
+}
+
+func marshalPage(pg *page) (buf []byte, rerr error) {
+	w := &writer{}
+	defer w.handle(&rerr)
+
+	if pg.ID == "" {
+		w.errorf("missing ID")
+	}
+	w.Linef("v2")
+	w.Header("ID", pg.ID)
+	w.Bool("Status", pg.Active, "inactive", "active")
+	w.Header("Slug", pg.Slug)
+	w.Header("Title", pg.Title)
+	w.Time("Time", pg.Time)
+	w.OptTime("Updated", pg.Updated)
+	w.OptInt("Menu", pg.Menu)
+	w.Flag("Legacy-Templates", pg.LegacyTemplates)
+	w.Linef("body:")
+	w.Text(pg.Body)
+	return w.buf.Bytes(), nil
+}
+
+// pageVersion returns a token for the current contents of a page, for
+// detecting concurrent edits.
+func pageVersion(pg *page) string {
+	buf, err := marshalPage(pg)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(buf)
+	return fmt.Sprintf("%x", h[:16])
+}
+
+func writePage(pg *page) error {
+	buf, err := marshalPage(pg)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fmt.Sprintf("data/page/%s/page.txt", pg.ID), buf)
+}
+
+func deletePage(pg *page) error {
+	if pg.ID == "" {
+		return errNoID
+	}
+	if err := os.RemoveAll(fmt.Sprintf("data/page/%s", pg.ID)); err != nil {
+		return err
+	}
+	return syncDir("data/page")
+}
+
+func (s *store) page(id string) *page {
+	for _, pg := range s.Pages {
+		if pg.ID == id {
+			return pg
+		}
+	}
+	abort(404)
+	return nil // not reached
+}
+
+func (s *store) findPageBySlug(slug string) *page {
+	for _, pg := range s.Pages {
+		if pg.Slug == slug {
+			return pg
+		}
+	}
+	return nil
+}
+
+// menuPages returns the active pages in the navigation menu, in menu order.
+func (s *store) menuPages() []*page {
+	var l []*page
+	for _, pg := range s.Pages {
+		if pg.Active && pg.Menu != 0 {
+			l = append(l, pg)
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].Menu < l[j].Menu
+	})
+	return l
+}
+
+// menu is the template function for the navigation menu.
+func menu() []*page {
+	data, err := loadStore()
+	httpCheck(err)
+	return data.menuPages()
+}
+
+// publicPage serves the page for path, which is of the form "<slug>/". It
+// returns false if there is no such page.
+func publicPage(w http.ResponseWriter, r *http.Request, data *store) bool {
+	slug, trailing := strings.CutSuffix(r.URL.Path, "/")
+	if strings.Contains(slug, "/") {
+		return false
+	}
+	pg := data.findPageBySlug(slug)
+	if pg == nil || !pg.Active {
+		return false
+	}
+	if !trailing {
+		http.Redirect(w, r, page2url(slug), http.StatusMovedPermanently)
+		return true
+	}
+	servePage(w, "t/page.html", map[string]interface{}{
+		"page": pg,
+	}, newImageBudget(config.PageBudget), fmt.Sprintf("data/www/%s/index.html", slug))
+	return true
+}
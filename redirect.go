@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// redirect is an entry in the redirect table in data/redirects.txt, for URLs
+// of an earlier blog. The file starts with a version line "v1", followed by a
+// line per redirect with From and To separated by a space.
+type redirect struct {
+	From string // Path relative to the base URL, optionally with "?query".
+	To   string // Path relative to the base URL, or absolute URL.
+}
+
+// Target returns the absolute URL to redirect to.
+func (rd *redirect) Target() string {
+	if strings.Contains(rd.To, "://") {
+		return rd.To
+	}
+	return config.BaseURL + rd.To
+}
+
+// readRedirects reads the redirect table, a missing file is an empty table.
+func readRedirects(filename string) (l []*redirect, rerr error) {
+	p := &parser{filename: filename}
+	defer p.handle(&rerr)
+	f, err := os.Open(filename)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	p.check(err, "open redirects file")
+	defer f.Close()
+
+	p.r = bufio.NewReader(f)
+
+	p.Literal("v1")
+	for {
+		if _, err := p.r.Peek(1); err != nil {
+			break
+		}
+		line := p.readline()
+		t := strings.Split(line, " ")
+		if len(t) != 2 || t[0] == "" || t[1] == "" {
+			p.errorf("got %q, expected redirect line %q", line, "from to")
+		}
+		l = append(l, &redirect{t[0], t[1]})
+	}
+	return
+}
+
+func writeRedirects(l []*redirect) (rerr error) {
+	w := &writer{}
+	defer w.handle(&rerr)
+
+	w.Linef("v1")
+	for _, rd := range l {
+		if rd.From == "" || rd.To == "" || strings.ContainsAny(rd.From+rd.To, " \t\r\n") {
+			w.errorf("invalid redirect from %q to %q", rd.From, rd.To)
+		}
+		w.Linef("%s %s", rd.From, rd.To)
+	}
+	err := writeFileAtomic("data/redirects.txt", w.buf.Bytes())
+	w.check(err, "writing redirects")
+	return
+}
+
+func (s *store) findRedirect(from string) *redirect {
+	for _, rd := range s.Redirects {
+		if rd.From == from {
+			return rd
+		}
+	}
+	return nil
+}
+
+// serveRedirect redirects permanently if the request path, with the query
+// string or without, is in the redirect table. The path must already have the
+// base path stripped.
+func serveRedirect(w http.ResponseWriter, r *http.Request, data *store) bool {
+	var rd *redirect
+	if r.URL.RawQuery != "" {
+		rd = data.findRedirect(r.URL.Path + "?" + r.URL.RawQuery)
+	}
+	if rd == nil {
+		rd = data.findRedirect(r.URL.Path)
+	}
+	if rd == nil {
+		return false
+	}
+	http.Redirect(w, r, rd.Target(), http.StatusMovedPermanently)
+	return true
+}
+
+// parseRedirect parses a redirect as entered in the admin.
+func parseRedirect(from, to string) *redirect {
+	from = strings.TrimPrefix(strings.TrimSpace(from), baseURL.Path)
+	to = strings.TrimSpace(to)
+	if strings.HasPrefix(to, baseURL.Path) {
+		to = strings.TrimPrefix(to, baseURL.Path)
+	}
+	if err := checkRedirect(from, to); err != nil {
+		abortUserError(err.Error())
+	}
+	return &redirect{from, to}
+}
+
+// checkRedirect checks a redirect with from and to relative to the base URL.
+func checkRedirect(from, to string) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("From and to are required.")
+	}
+	if strings.ContainsAny(from+to, " \t\r\n") {
+		return fmt.Errorf("From and to cannot contain whitespace.")
+	}
+	if strings.HasPrefix(from, "a/") || strings.HasPrefix(from, "s/") {
+		return fmt.Errorf("Cannot redirect admin or static paths.")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckRedirect(t *testing.T) {
+	test := func(from, to string, xerr bool) {
+		t.Helper()
+		if err := checkRedirect(from, to); (err != nil) != xerr {
+			t.Fatalf("%q to %q: got err %v, expected error %v", from, to, err, xerr)
+		}
+	}
+
+	test("old/page", "about/", false)
+	test("index.php?p=1", "https://example.com/", false)
+	test("", "about/", true)
+	test("old", "", true)
+	test("old page", "about/", true)
+	test("old", "about/\n", true)
+	test("a/posts", "about/", true)
+	test("s/style.css", "about/", true)
+}
+
+func TestParseRedirect(t *testing.T) {
+	testDataDir(t)
+	config.BaseURL = "https://example.org/blog/"
+	baseURL, _ = url.Parse(config.BaseURL)
+
+	test := func(from, to, xfrom, xto string) {
+		t.Helper()
+		var rd *redirect
+		func() {
+			defer func() {
+				if err := recover(); err != nil && xfrom != "" {
+					t.Fatalf("%q to %q: %v", from, to, err)
+				}
+			}()
+			rd = parseRedirect(from, to)
+		}()
+		if xfrom == "" {
+			if rd != nil {
+				t.Fatalf("%q to %q: got %v, expected error", from, to, rd)
+			}
+			return
+		}
+		if rd == nil || rd.From != xfrom || rd.To != xto {
+			t.Fatalf("%q to %q: got %v, expected %q to %q", from, to, rd, xfrom, xto)
+		}
+	}
+
+	test("/blog/old/page", "/blog/p/new/", "old/page", "p/new/")
+	test(" old?id=1 ", " p/new/ ", "old?id=1", "p/new/")
+	test("/blog/index.php?p=1", "https://example.com/", "index.php?p=1", "https://example.com/")
+	test("/other/page", "p/new/", "/other/page", "p/new/")
+	test("/blog/", "p/new/", "", "")
+	test("old", "", "", "")
+	test("old page", "p/new/", "", "")
+	test("/blog/a/posts", "p/new/", "", "")
+	test("s/style.css", "p/new/", "", "")
+}
+
+func TestServeRedirect(t *testing.T) {
+	testDataDir(t)
+
+	p := &post{ID: "post1", Active: true, Slug: "new", OldSlugs: []string{"old"}, Title: "New", Time: time.Now(), Body: "Body.\n"}
+	draft := &post{ID: "post2", Slug: "draft", OldSlugs: []string{"olddraft"}, Title: "Draft", Time: time.Now(), Body: "Body.\n"}
+	for _, err := range []error{
+		writePost(p),
+		writePost(draft),
+		writeRedirects([]*redirect{{"old/page", "p/new/"}, {"index.php?p=1", "https://example.com/"}, {"index.php", "about/"}, {"p/gone/", "p/new/"}}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeChanged()
+	data, err := loadStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd := data.findRedirect("old/page"); rd == nil || rd.Target() != "https://example.org/p/new/" {
+		t.Fatalf("findRedirect: got %v", rd)
+	}
+	if rd := data.findRedirect("old/page/"); rd != nil {
+		t.Fatalf("findRedirect with trailing slash: got %v, expected none", rd)
+	}
+
+	test := func(fn http.HandlerFunc, path string, code int, location string) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/"+path, nil)
+		r.URL.Path = r.URL.Path[1:]
+		w := httptest.NewRecorder()
+		handleHTTPError(fn)(w, r)
+		if w.Code != code || w.Header().Get("Location") != location {
+			t.Fatalf("%s: got %d %q, expected %d %q", path, w.Code, w.Header().Get("Location"), code, location)
+		}
+	}
+
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		if !serveRedirect(w, r, data) {
+			abort(404)
+		}
+	}
+	test(serve, "old/page", 301, "https://example.org/p/new/")
+	test(serve, "old/page/", 404, "")
+	test(serve, "index.php?p=1", 301, "https://example.com/")
+	test(serve, "index.php?p=2", 301, "https://example.org/about/")
+	test(serve, "nothing", 404, "")
+
+	test(publicPost, "p/old/", 301, "https://example.org/p/new/")
+	test(publicPost, "p/old", 301, "https://example.org/p/old/")
+	test(publicPost, "p/olddraft/", 404, "")
+	test(publicPost, "p/gone/", 301, "https://example.org/p/new/")
+	test(publicPost, "p/missing/", 404, "")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Revisions are earlier versions of a post, kept as copies of post.txt in
+// data/post/<postid>/revisions/<time>.txt, with the time of the save in UTC.
+
+const revisionTimeFormat = "20060102T150405.000000000Z"
+
+type revision struct {
+	ID   string // Time formatted with revisionTimeFormat.
+	Time time.Time
+	Post *post
+}
+
+// saveRevision keeps a copy of the current post.txt of the post.
+func saveRevision(postID string) error {
+	buf, err := os.ReadFile(fmt.Sprintf("data/post/%s/post.txt", postID))
+	if err != nil {
+		return err
+	}
+	id := time.Now().UTC().Format(revisionTimeFormat)
+	return writeFileAtomic(fmt.Sprintf("data/post/%s/revisions/%s.txt", postID, id), buf)
+}
+
+// readRevisions returns the revisions of a post, newest first. Revisions that
+// cannot be parsed are skipped.
+func readRevisions(postID string) ([]*revision, error) {
+	dir := fmt.Sprintf("data/post/%s/revisions", postID)
+	l, err := os.ReadDir(dir)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("listing revisions: %s", err)
+	}
+	var revs []*revision
+	for _, fi := range l {
+		if strings.HasPrefix(fi.Name(), ".") || !strings.HasSuffix(fi.Name(), ".txt") {
+			continue
+		}
+		id := strings.TrimSuffix(fi.Name(), ".txt")
+		tm, err := time.Parse(revisionTimeFormat, id)
+		if err != nil {
+			log.Printf("skipping revision with bad name %s/%s", dir, fi.Name())
+			continue
+		}
+		p, err := readPost(dir+"/"+fi.Name(), postID)
+		if err != nil {
+			log.Printf("skipping corrupt revision: %s", err)
+			continue
+		}
+		revs = append(revs, &revision{id, tm, p})
+	}
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Time.After(revs[j].Time)
+	})
+	return revs, nil
+}
+
+func findRevision(postID, id string) *revision {
+	revs, err := readRevisions(postID)
+	httpCheck(err)
+	for _, rev := range revs {
+		if rev.ID == id {
+			return rev
+		}
+	}
+	abort(404)
+	return nil // not reached
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// scheduleChanged wakes up publishScheduled after changes to the store, posts may
+// have been scheduled.
+var scheduleChanged = make(chan struct{}, 1)
+
+func wakeScheduler() {
+	select {
+	case scheduleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// publishScheduled removes cached pages when posts are published or expire at
+// their scheduled time, so the next request generates them with the change.
+func publishScheduled() {
+	// Posts may have been published or expired while blogx was not running,
+	// cached pages from before could be showing the old state.
+	removeAllWritethrough()
+	last := time.Now()
+	for {
+		// Wake up at the next scheduled time, or every minute when nothing is
+		// scheduled, or after changes.
+		next := time.Now().Add(time.Minute)
+		data, err := loadStore()
+		if err != nil {
+			log.Printf("loading store for scheduled posts: %v", err)
+		} else {
+			for _, p := range data.Posts {
+				for _, tm := range []time.Time{p.Publish, p.Expire} {
+					if tm.After(last) && tm.Before(next) {
+						next = tm
+					}
+				}
+			}
+		}
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-t.C:
+		case <-scheduleChanged:
+			t.Stop()
+		}
+
+		now := time.Now()
+		data, err = loadStore()
+		if err != nil {
+			log.Printf("loading store for scheduled posts: %v", err)
+			continue
+		}
+		var changed bool
+		for _, p := range data.Posts {
+			if !p.Active {
+				continue
+			}
+			for _, tm := range []time.Time{p.Publish, p.Expire} {
+				if tm.After(last) && !tm.After(now) {
+					log.Printf("post %s %q reached scheduled time %s, removing cached pages", p.ID, p.Slug, tm.Format(time.RFC3339))
+					changed = true
+				}
+			}
+		}
+		if changed {
+			// Other posts and pages may link to the post, links are only
+			// shown to published posts.
+			removeAllWritethrough()
+		}
+		last = now
+	}
+}
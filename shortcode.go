@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	textTemplate "text/template"
+)
+
+// Bodies of posts and pages can contain shortcodes, expanded when rendering:
+//
+//	{{< image cat w=600 alt="A cat" >}}
+//	{{< note >}}Some *markdown*.{{< /note >}}
+//
+// Only the shortcodes in shortcodeDefs exist, and their arguments are checked
+// when a post or page is saved. A literal "{{<", e.g. in a code block, is
+// written as "\{{<". Posts and pages from before shortcodes can opt in to
+// having their body executed as template instead, see LegacyTemplates.
+//
+// Shortcodes are replaced by placeholders before the markdown is rendered, and
+// the placeholders by the html of the shortcodes after, so markdown does not
+// change their html.
+
+type shortcode struct {
+	Name      string
+	Line      int               // Of the opening tag in the body, for errors.
+	Args      []string          // Positional arguments.
+	Params    map[string]string // Arguments given as key=value.
+	Inner     string            // Content of a paired shortcode.
+	InnerLine int
+}
+
+type shortcodeDef struct {
+	paired   bool     // Has content, ended with {{< /name >}}.
+	markdown bool     // Output is markdown to render, instead of html.
+	params   []string // Allowed key=value arguments.
+	fn       func(r *shortcodeRenderer, sc *shortcode) string
+}
+
+var shortcodeDefs map[string]shortcodeDef
+
+func init() {
+	// In init, the functions refer to shortcodeDefs through expand.
+	shortcodeDefs = map[string]shortcodeDef{
+		"image":   {params: []string{"w", "h", "alt", "title"}, fn: shortcodeImage},
+		"figure":  {params: []string{"w", "h", "alt", "caption"}, fn: shortcodeFigure},
+		"gallery": {params: []string{"w", "h"}, fn: shortcodeGallery},
+		"video":   {fn: shortcodeVideo},
+		"note":    {paired: true, fn: shortcodeNote},
+		"spoiler": {paired: true, fn: shortcodeSpoiler},
+		"include": {markdown: true, fn: shortcodeInclude},
+	}
+}
+
+type shortcodeRenderer struct {
+	data      *store
+	budget    *imageBudget
+	checkOnly bool
+	errors    []string
+	prefix    string   // For errors in included pages.
+	html      []string // Output of shortcodes, by placeholder.
+	includes  []string // Slugs of pages being included, for detecting loops.
+
+	// Renders all markdown of the body, including in notes and spoilers, so
+	// heading ids are unique and all headings are in the table of contents.
+	hr     *headerHTMLRenderer
+	nested map[int]string // Expanded markdown of notes and spoilers, by placeholder, until rendered.
+}
+
+// Pages include pages up to maxIncludeDepth deep.
+const maxIncludeDepth = 5
+
+func (r *shortcodeRenderer) loadData() *store {
+	if r.data == nil {
+		data, err := loadStore()
+		httpCheck(err)
+		r.data = data
+	}
+	return r.data
+}
+
+func (r *shortcodeRenderer) errorf(sc *shortcode, format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf("%sline %d: %s: %s", r.prefix, sc.Line, sc.Name, fmt.Sprintf(format, args...)))
+}
+
+func (r *shortcodeRenderer) placeholder(html string) string {
+	r.html = append(r.html, html)
+	return fmt.Sprintf("blogxshortcode%dx", len(r.html)-1)
+}
+
+// markdown renders markdown md with shortcodes, starting at line in the body,
+// to html. With checkOnly, the shortcodes are only checked.
+func (r *shortcodeRenderer) markdown(md string, line int) string {
+	if r.hr != nil {
+		// Markdown in a note or spoiler, rendered when the renderer of the body
+		// reaches its placeholder, so headings are in document order.
+		s := r.expand(md, line)
+		ph := r.placeholder("")
+		if r.nested == nil {
+			r.nested = map[int]string{}
+		}
+		r.nested[len(r.html)-1] = s
+		return ph
+	}
+	if !r.checkOnly {
+		r.hr = newHeaderHTMLRenderer()
+		r.hr.data = r.data
+		r.hr.budget = r.budget
+		r.hr.textHook = func(text []byte) {
+			r.renderNested(string(text), len(r.html))
+		}
+		defer func() {
+			r.hr = nil
+		}()
+	}
+	s := r.expand(md, line)
+	if r.checkOnly {
+		return ""
+	}
+	out := string(r.hr.render([]byte(s)))
+	// Placeholders the renderer did not see as text, e.g. in code.
+	r.renderNested(out, len(r.html))
+	out = r.fill(out, len(r.html))
+	if strings.Contains(out, tocMarker) {
+		out = strings.ReplaceAll(out, tocMarker, toc(r.hr.headings))
+	}
+	return out
+}
+
+var placeholderRegexp = regexp.MustCompile(`<p>blogxshortcode([0-9]+)x</p>|blogxshortcode([0-9]+)x`)
+
+// placeholders calls fn for the placeholders in s below max, and replaces
+// them with the result. Html of a shortcode only has placeholders of lower
+// numbers.
+func placeholders(s string, max int, fn func(i int) string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(s, func(ph string) string {
+		m := placeholderRegexp.FindStringSubmatch(ph)
+		i, err := strconv.Atoi(m[1] + m[2])
+		if err != nil || i >= max {
+			return ph
+		}
+		return fn(i)
+	})
+}
+
+// renderNested renders the markdown of notes and spoilers for the placeholders
+// in s, and in their html, below max.
+func (r *shortcodeRenderer) renderNested(s string, max int) {
+	placeholders(s, max, func(i int) string {
+		if md, ok := r.nested[i]; ok {
+			delete(r.nested, i)
+			r.html[i] = string(r.hr.render([]byte(md)))
+		}
+		r.renderNested(r.html[i], i)
+		return ""
+	})
+}
+
+// fill replaces the placeholders below max in rendered html s. A placeholder
+// that is the only content of a paragraph replaces the paragraph.
+func (r *shortcodeRenderer) fill(s string, max int) string {
+	return placeholders(s, max, func(i int) string {
+		return r.fill(r.html[i], i)
+	})
+}
+
+// expand returns md, starting at line in the body, with its shortcodes replaced
+// by placeholders. Shortcodes with errors are left as written.
+func (r *shortcodeRenderer) expand(md string, line int) string {
+	var b strings.Builder
+	s := md
+	for {
+		i := strings.Index(s, "{{<")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		line += strings.Count(s[:i], "\n")
+		if i > 0 && s[i-1] == '\\' {
+			b.WriteString(s[:i-1])
+			b.WriteString("{{<")
+			s = s[i+3:]
+			continue
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		sc, n, err := parseShortcode(s)
+		if err != nil {
+			r.errors = append(r.errors, fmt.Sprintf("%sline %d: %v", r.prefix, line, err))
+			b.WriteString(s[:3])
+			s = s[3:]
+			continue
+		}
+		sc.Line = line
+		nerrors := len(r.errors)
+		def, ok := shortcodeDefs[sc.Name]
+		if !ok && strings.HasPrefix(sc.Name, "/") {
+			r.errorf(sc, "closing tag without opening tag")
+		} else if !ok {
+			r.errorf(sc, "unknown shortcode, must be one of %s", strings.Join(shortcodeNames(), ", "))
+		} else if def.paired {
+			end := regexp.MustCompile(`\{\{<\s*/` + regexp.QuoteMeta(sc.Name) + `\s*>\}\}`).FindStringIndex(s[n:])
+			if end == nil {
+				r.errorf(sc, "missing closing tag {{< /%s >}}", sc.Name)
+			} else {
+				sc.Inner = s[n : n+end[0]]
+				sc.InnerLine = line + strings.Count(s[:n], "\n")
+				n += end[1]
+			}
+		}
+		for k := range sc.Params {
+			if ok && !contains(def.params, k) {
+				r.errorf(sc, "unknown parameter %q", k)
+			}
+		}
+		source := s[:n]
+		line += strings.Count(source, "\n")
+		s = s[n:]
+
+		var out string
+		if len(r.errors) == nerrors {
+			out = def.fn(r, sc)
+		}
+		switch {
+		case r.checkOnly:
+		case len(r.errors) > nerrors:
+			b.WriteString(r.placeholder(html.EscapeString(source)))
+		case def.markdown:
+			b.WriteString(out)
+		default:
+			b.WriteString(r.placeholder(out))
+		}
+	}
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func shortcodeNames() []string {
+	var l []string
+	for name := range shortcodeDefs {
+		l = append(l, name)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// parseShortcode parses the tag at the start of s, e.g. {{< name a "b c" k=v >}},
+// and returns its length.
+func parseShortcode(s string) (*shortcode, int, error) {
+	sc := &shortcode{Params: map[string]string{}}
+	o := 3
+	// value parses a word or a quoted string.
+	value := func() (string, error) {
+		start := o
+		if o < len(s) && s[o] == '"' {
+			for o++; o < len(s) && s[o] != '"' && s[o] != '\n'; o++ {
+				if s[o] == '\\' {
+					o++
+				}
+			}
+			if o >= len(s) || s[o] != '"' {
+				return "", errors.New("unterminated quoted string in shortcode")
+			}
+			o++
+			v, err := strconv.Unquote(s[start:o])
+			if err != nil {
+				return "", fmt.Errorf("invalid quoted string %s in shortcode", s[start:o])
+			}
+			return v, nil
+		}
+		for o < len(s) && !strings.ContainsRune(" \t\n\"=", rune(s[o])) && !strings.HasPrefix(s[o:], ">}}") {
+			o++
+		}
+		return s[start:o], nil
+	}
+	for {
+		for o < len(s) && (s[o] == ' ' || s[o] == '\t') {
+			o++
+		}
+		if strings.HasPrefix(s[o:], ">}}") {
+			o += 3
+			break
+		}
+		if o >= len(s) || s[o] == '\n' {
+			return nil, 0, errors.New("unterminated shortcode, missing >}} on the same line")
+		}
+		quoted := s[o] == '"'
+		v, err := value()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !quoted && o < len(s) && s[o] == '=' {
+			o++
+			if v == "" {
+				return nil, 0, errors.New("missing parameter name before = in shortcode")
+			}
+			if _, ok := sc.Params[v]; ok {
+				return nil, 0, fmt.Errorf("duplicate parameter %q in shortcode", v)
+			}
+			sc.Params[v], err = value()
+			if err != nil {
+				return nil, 0, err
+			}
+		} else if sc.Name == "" {
+			if quoted || v == "" {
+				return nil, 0, errors.New("missing shortcode name")
+			}
+			sc.Name = v
+		} else {
+			sc.Args = append(sc.Args, v)
+		}
+	}
+	if sc.Name == "" {
+		return nil, 0, errors.New("missing shortcode name")
+	}
+	return sc, o, nil
+}
+
+// shortcodeArg returns s as argument in a shortcode tag, quoted if needed.
+func shortcodeArg(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=\\") || strings.Contains(s, ">}}") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// findImage returns the image for slug, reporting an error if it does not exist.
+func (r *shortcodeRenderer) findImage(sc *shortcode, slug string) *image {
+	img := r.loadData().findImageBySlug(slug)
+	if img == nil {
+		r.errorf(sc, "image %q does not exist", slug)
+	}
+	return img
+}
+
+// imageSize returns the w and h parameters, or the defaults if absent.
+func (r *shortcodeRenderer) imageSize(sc *shortcode, width, height uint) (uint, uint) {
+	for k, v := range map[string]*uint{"w": &width, "h": &height} {
+		if s, ok := sc.Params[k]; ok {
+			n, ok := parseImageDimension(s)
+			if !ok {
+				r.errorf(sc, "invalid %s %q, must be a positive number", k, s)
+			}
+			*v = n
+		}
+	}
+	return width, height
+}
+
+// oneArg returns the single positional argument, reporting an error if there
+// is not exactly one.
+func (r *shortcodeRenderer) oneArg(sc *shortcode, what string) string {
+	if len(sc.Args) != 1 {
+		r.errorf(sc, "got %d arguments, expected %s", len(sc.Args), what)
+		return ""
+	}
+	return sc.Args[0]
+}
+
+// imageRef returns the html for the image shortcodes, or false on errors.
+func (r *shortcodeRenderer) imageRef(sc *shortcode, slug string, width, height uint, alt, title string) (string, bool) {
+	img := r.findImage(sc, slug)
+	if img == nil {
+		return "", false
+	}
+	if !strings.HasPrefix(img.Mimetype, "image/") {
+		r.errorf(sc, "%q is not an image", slug)
+		return "", false
+	}
+	if r.checkOnly {
+		return "", true
+	}
+	if alt == "" {
+		alt = img.AltText()
+	}
+	var b bytes.Buffer
+	writeImageRef(&b, img, width, height, []byte(title), []byte(alt), r.budget)
+	return b.String(), true
+}
+
+// {{< image slug w=600 h=400 alt="..." title="..." >}}
+func shortcodeImage(r *shortcodeRenderer, sc *shortcode) string {
+	slug := r.oneArg(sc, "an image slug")
+	width, height := r.imageSize(sc, 0, 0)
+	if slug == "" {
+		return ""
+	}
+	s, _ := r.imageRef(sc, slug, width, height, sc.Params["alt"], sc.Params["title"])
+	return s
+}
+
+// {{< figure slug w=600 h=400 alt="..." caption="..." >}}, the caption defaults
+// to the title of the image.
+func shortcodeFigure(r *shortcodeRenderer, sc *shortcode) string {
+	slug := r.oneArg(sc, "an image slug")
+	width, height := r.imageSize(sc, 0, 0)
+	if slug == "" {
+		return ""
+	}
+	s, ok := r.imageRef(sc, slug, width, height, sc.Params["alt"], "")
+	if !ok || r.checkOnly {
+		return ""
+	}
+	caption, ok := sc.Params["caption"]
+	if !ok {
+		caption = r.loadData().findImageBySlug(slug).Title
+	}
+	if caption != "" {
+		s += "<figcaption>" + html.EscapeString(caption) + "</figcaption>"
+	}
+	return "<figure>" + s + "</figure>"
+}
+
+// {{< gallery slug1 slug2 ... w=300 h=300 >}}, thumbnails fit within 300x300
+// by default.
+func shortcodeGallery(r *shortcodeRenderer, sc *shortcode) string {
+	if len(sc.Args) == 0 {
+		r.errorf(sc, "missing image slugs")
+	}
+	width, height := r.imageSize(sc, 300, 300)
+	s := `<div class="gallery">`
+	for _, slug := range sc.Args {
+		h, _ := r.imageRef(sc, slug, width, height, "", "")
+		s += h
+	}
+	return s + "</div>"
+}
+
+// {{< video slug controls muted loop autoplay >}}
+func shortcodeVideo(r *shortcodeRenderer, sc *shortcode) string {
+	if len(sc.Args) == 0 {
+		r.errorf(sc, "missing video slug")
+		return ""
+	}
+	slug, options := sc.Args[0], sc.Args[1:]
+	for _, opt := range options {
+		if _, ok := videoOptions[opt]; !ok {
+			r.errorf(sc, "unknown option %q, must be controls, muted, loop or autoplay", opt)
+		}
+	}
+	img := r.findImage(sc, slug)
+	if img == nil {
+		return ""
+	}
+	if !img.isVideo() {
+		r.errorf(sc, "%q is not a video", slug)
+		return ""
+	}
+	if r.checkOnly {
+		return ""
+	}
+	return string(video(strings.Join(options, " "), img))
+}
+
+// {{< note >}}markdown{{< /note >}}
+func shortcodeNote(r *shortcodeRenderer, sc *shortcode) string {
+	if len(sc.Args) > 0 {
+		r.errorf(sc, "unexpected arguments")
+	}
+	return `<aside class="note">` + r.markdown(sc.Inner, sc.InnerLine) + "</aside>"
+}
+
+// {{< spoiler "summary" >}}markdown{{< /spoiler >}}, hidden until the summary
+// is clicked. The summary is optional.
+func shortcodeSpoiler(r *shortcodeRenderer, sc *shortcode) string {
+	summary := "Spoiler"
+	switch len(sc.Args) {
+	case 0:
+	case 1:
+		summary = sc.Args[0]
+	default:
+		r.errorf(sc, "got %d arguments, expected an optional summary", len(sc.Args))
+	}
+	return `<details class="spoiler"><summary>` + html.EscapeString(summary) + "</summary>" + r.markdown(sc.Inner, sc.InnerLine) + "</details>"
+}
+
+// {{< include slug >}} includes the body of an active page.
+func shortcodeInclude(r *shortcodeRenderer, sc *shortcode) string {
+	slug := r.oneArg(sc, "a page slug")
+	if slug == "" {
+		return ""
+	}
+	pg := r.loadData().findPageBySlug(slug)
+	switch {
+	case pg == nil:
+		r.errorf(sc, "page %q does not exist", slug)
+		return ""
+	case !pg.Active:
+		r.errorf(sc, "page %q is not active", slug)
+		return ""
+	case pg.LegacyTemplates:
+		r.errorf(sc, "page %q uses legacy templates and cannot be included", slug)
+		return ""
+	case contains(r.includes, slug):
+		r.errorf(sc, "page %q includes itself", slug)
+		return ""
+	case len(r.includes) >= maxIncludeDepth:
+		r.errorf(sc, "pages included more than %d deep", maxIncludeDepth)
+		return ""
+	}
+	prefix := r.prefix
+	r.prefix = fmt.Sprintf("%sline %d: include %q: ", prefix, sc.Line, slug)
+	r.includes = append(r.includes, slug)
+	defer func() {
+		r.prefix = prefix
+		r.includes = r.includes[:len(r.includes)-1]
+	}()
+	return r.expand(strings.ReplaceAll(pg.Body, tocMarker, ""), 1)
+}
+
+// renderShortcodeMarkdown renders markdown md with shortcodes to html.
+// Shortcodes with errors are shown as written, and the errors logged.
+func renderShortcodeMarkdown(md string, budget *imageBudget) string {
+	r := &shortcodeRenderer{budget: budget}
+	s := r.markdown(md, 1)
+	if len(r.errors) > 0 {
+		log.Printf("rendering shortcodes: %s", strings.Join(r.errors, "; "))
+	}
+	return s
+}
+
+// checkShortcodes returns an error if md has unknown shortcodes, invalid
+// arguments, or references images or pages that are not in data. Included pages
+// are checked too, for loops back to page, the slug of the page md is the body
+// of, or empty for posts.
+func checkShortcodes(data *store, page, md string) error {
+	r := &shortcodeRenderer{data: data, checkOnly: true}
+	if page != "" {
+		r.includes = []string{page}
+	}
+	r.markdown(md, 1)
+	if len(r.errors) > 0 {
+		return errors.New(strings.Join(r.errors, "; "))
+	}
+	return nil
+}
+
+// checkBody returns an error if md, a body or summary, has bad shortcodes, or
+// with legacy templates, cannot be parsed as template. Page is the slug for
+// the body of a page, see checkShortcodes.
+func checkBody(data *store, page, md string, legacy bool) error {
+	if legacy {
+		_, err := textTemplate.New("body").Funcs(textFuncs).Parse(md)
+		return err
+	}
+	return checkShortcodes(data, page, md)
+}
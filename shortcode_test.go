@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseShortcode(t *testing.T) {
+	test := func(s, name string, args []string, params map[string]string, length int, expErr string) {
+		t.Helper()
+		sc, n, err := parseShortcode(s)
+		var errs string
+		if err != nil {
+			errs = err.Error()
+		}
+		if errs != expErr {
+			t.Fatalf("parseShortcode %q: got error %q, expected %q", s, errs, expErr)
+		}
+		if err != nil {
+			return
+		}
+		if sc.Name != name || !reflect.DeepEqual(sc.Args, args) || !reflect.DeepEqual(sc.Params, params) || n != length {
+			t.Fatalf("parseShortcode %q: got %q %q %v %d, expected %q %q %v %d", s, sc.Name, sc.Args, sc.Params, n, name, args, params, length)
+		}
+	}
+
+	test(`{{< image cat >}} rest`, "image", []string{"cat"}, map[string]string{}, 17, "")
+	test(`{{<image cat w=600 alt="A \"big\" cat">}}`, "image", []string{"cat"}, map[string]string{"w": "600", "alt": `A "big" cat`}, 41, "")
+	test(`{{< spoiler "a b" >}}`, "spoiler", []string{"a b"}, map[string]string{}, 21, "")
+	test(`{{< /note >}}`, "/note", nil, map[string]string{}, 13, "")
+	test(`{{< >}}`, "", nil, nil, 0, "missing shortcode name")
+	test(`{{< "image" >}}`, "", nil, nil, 0, "missing shortcode name")
+	test("{{< image cat\n>}}", "", nil, nil, 0, "unterminated shortcode, missing >}} on the same line")
+	test(`{{< image alt="cat >}}`, "", nil, nil, 0, "unterminated quoted string in shortcode")
+	test(`{{< image w=1 w=2 >}}`, "", nil, nil, 0, `duplicate parameter "w" in shortcode`)
+	test(`{{< image =1 >}}`, "", nil, nil, 0, "missing parameter name before = in shortcode")
+}
+
+func TestCheckShortcodes(t *testing.T) {
+	data := &store{
+		Images: []*image{{Slug: "cat", Mimetype: "image/jpeg"}, {Slug: "clip", Mimetype: "video/mp4"}},
+		Pages: []*page{
+			{Slug: "about", Active: true, Body: "About."},
+			{Slug: "draft", Body: "Draft."},
+			{Slug: "a", Active: true, Body: "{{< include b >}}"},
+			{Slug: "b", Active: true, Body: "x\n{{< include a >}}"},
+			{Slug: "d1", Active: true, Body: "{{< include d2 >}}"},
+			{Slug: "d2", Active: true, Body: "{{< include d3 >}}"},
+			{Slug: "d3", Active: true, Body: "{{< include d4 >}}"},
+			{Slug: "d4", Active: true, Body: "{{< include d5 >}}"},
+			{Slug: "d5", Active: true, Body: "{{< include about >}}"},
+		},
+	}
+	testPage := func(page, md, exp string) {
+		t.Helper()
+		err := checkShortcodes(data, page, md)
+		var s string
+		if err != nil {
+			s = err.Error()
+		}
+		if s != exp {
+			t.Fatalf("checkShortcodes %q: got error %q, expected %q", md, s, exp)
+		}
+	}
+	test := func(md, exp string) {
+		t.Helper()
+		testPage("", md, exp)
+	}
+
+	test(`{{< image cat w=600 >}} {{< figure cat caption="Cat" >}} {{< gallery cat cat h=100 >}} {{< video clip controls muted >}} {{< include about >}}`, "")
+	test("{{< note >}}\n{{< image cat >}}\n{{< /note >}}\n{{< spoiler >}}x{{< /spoiler >}}", "")
+	test(`\{{< image dog >}}`, "")
+	test("text\n\n{{< image dog >}}", `line 3: image: image "dog" does not exist`)
+	test("{{< img cat >}}", "line 1: img: unknown shortcode, must be one of figure, gallery, image, include, note, spoiler, video")
+	test("{{< image cat w=x >}}", `line 1: image: invalid w "x", must be a positive number`)
+	test("{{< image cat size=1 >}}", `line 1: image: unknown parameter "size"`)
+	test("{{< image cat dog >}}", "line 1: image: got 2 arguments, expected an image slug")
+	test("{{< image clip >}}", `line 1: image: "clip" is not an image`)
+	test("{{< video cat >}}", `line 1: video: "cat" is not a video`)
+	test("{{< video clip fullscreen >}}", `line 1: video: unknown option "fullscreen", must be controls, muted, loop or autoplay`)
+	test("{{< note >}}\n\nx", "line 1: note: missing closing tag {{< /note >}}")
+	test("x\n{{< /note >}}", "line 2: /note: closing tag without opening tag")
+	test("{{< note >}}\n\n{{< image dog >}}\n{{< /note >}}", `line 3: image: image "dog" does not exist`)
+	test("{{< include draft >}}", `line 1: include: page "draft" is not active`)
+	testPage("a", "{{< include a >}}", `line 1: include: page "a" includes itself`)
+	testPage("a", "{{< include b >}}", `line 1: include "b": line 2: include: page "a" includes itself`)
+	test("{{< include d2 >}}", "")
+	test("{{< include d1 >}}", `line 1: include "d1": line 1: include "d2": line 1: include "d3": line 1: include "d4": line 1: include "d5": line 1: include: pages included more than 5 deep`)
+	test("{{< image\ncat >}}\n{{< image dog >}}", "line 1: unterminated shortcode, missing >}} on the same line; line 3: image: image \"dog\" does not exist")
+}
+
+func TestRenderShortcodes(t *testing.T) {
+	test := func(md, exp string) {
+		t.Helper()
+		r := &shortcodeRenderer{data: &store{}}
+		s := r.markdown(md, 1)
+		if s != exp {
+			t.Fatalf("shortcodes %q: got %q, expected %q", md, s, exp)
+		}
+	}
+
+	test("{{< note >}}Some *markdown*.{{< /note >}}\n", `<aside class="note"><p>Some <em>markdown</em>.</p>`+"\n</aside>\n")
+	test(`{{< spoiler "A <b>" >}}x{{< /spoiler >}}`, `<details class="spoiler"><summary>A &lt;b&gt;</summary><p>x</p>`+"\n</details>\n")
+	test("`\\{{< note >}}`\n", "<p><code>{{&lt; note &gt;}}</code></p>\n")
+	test("a {{< img >}} b\n", "<p>a {{&lt; img &gt;}} b</p>\n")
+
+	if s := renderShortcodeMarkdown("# A\n\n{{< note >}}b{{< /note >}}\n", nil); !strings.Contains(s, `<h2 id="a">`) || !strings.Contains(s, `<aside class="note"><p>b</p>`) {
+		t.Fatalf("renderShortcodeMarkdown: got %q", s)
+	}
+
+	// Headings in notes and spoilers get ids unique in the page, in document
+	// order, and are in the table of contents.
+	s := renderShortcodeMarkdown("<!--toc-->\n\n# A\n\n{{< spoiler >}}\n# A\n\n{{< note >}}\n# A\n{{< /note >}}\n{{< /spoiler >}}\n\n# A\n", nil)
+	ids := regexp.MustCompile(`<h2 id="([^"]+)"`).FindAllStringSubmatch(s, -1)
+	if len(ids) != 4 || ids[0][1] != "a" || ids[1][1] != "a-2" || ids[2][1] != "a-3" || ids[3][1] != "a-4" {
+		t.Fatalf("heading ids: got %q", s)
+	}
+	if !strings.Contains(s, `<li><a href="#a">A</a></li><li><a href="#a-2">A</a></li><li><a href="#a-3">A</a></li><li><a href="#a-4">A</a></li>`) {
+		t.Fatalf("table of contents: got %q", s)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"golang.org/x/net/html"
 	"io"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // after parsing, html/head/body etc tags have been added.
@@ -33,7 +35,7 @@ func renderBody(r *html.Node, w io.Writer) error {
 }
 
 type trunc struct {
-	left int
+	left int // In runes.
 }
 
 func (t *trunc) truncate(n *html.Node) {
@@ -43,10 +45,14 @@ func (t *trunc) truncate(n *html.Node) {
 	case html.DoctypeNode:
 
 	case html.TextNode:
-		nn := len(n.Data)
+		// Whitespace between elements is not visible text.
+		if strings.TrimSpace(n.Data) == "" {
+			return
+		}
+		nn := utf8.RuneCountInString(n.Data)
 		if t.left < nn {
+			n.Data = truncateWords(n.Data, t.left) + "..."
 			nn = t.left
-			n.Data = n.Data[:nn] + "..."
 		}
 		t.left -= nn
 	case html.DocumentNode, html.ElementNode:
@@ -61,15 +67,41 @@ func (t *trunc) truncate(n *html.Node) {
 	}
 }
 
-// parse s as html, and output it again as html, but stop when reaching certain length.
-// html tags are properly closed.  text is cut off and "..." appended.
+// truncateWords returns at most n runes of s, cut at the last whitespace so
+// words are kept whole. Only if there is no whitespace a word is cut.
+func truncateWords(s string, n int) string {
+	end := len(s)
+	for i := range s {
+		if n == 0 {
+			end = i
+			break
+		}
+		n--
+	}
+	if end == len(s) {
+		return s
+	}
+	// If the cut is at a word boundary, the last word is complete.
+	if r, _ := utf8.DecodeRuneInString(s[end:]); !unicode.IsSpace(r) {
+		if i := strings.LastIndexFunc(s[:end], unicode.IsSpace); i >= 0 {
+			end = i
+		}
+	}
+	return strings.TrimRightFunc(s[:end], func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
+}
+
+// parse s as html, and output it again as html, but stop when reaching n
+// characters of text. html tags are properly closed. text is cut off at a
+// word boundary and "..." appended.
 // the new html is returned, or an error.
-func htmltrunc(s string) (string, error) {
+func htmltrunc(s string, n int) (string, error) {
 	r, err := html.Parse(strings.NewReader(s))
 	if err != nil {
 		return "", err
 	}
-	t := &trunc{275}
+	t := &trunc{n}
 	t.truncate(r)
 	w := new(bytes.Buffer)
 	err = renderBody(r, w)
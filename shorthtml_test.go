@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHTMLTrunc(t *testing.T) {
+	test := func(s string, n int, exp string) {
+		t.Helper()
+		r, err := htmltrunc(s, n)
+		if err != nil {
+			t.Fatalf("htmltrunc %q: %v", s, err)
+		}
+		if r != exp {
+			t.Fatalf("htmltrunc %q, %d: got %q, expected %q", s, n, r, exp)
+		}
+	}
+
+	test("<p>short</p>", 10, "<p>short</p>")
+	test("<p>some words here</p>", 12, "<p>some words...</p>")
+	test("<p>some words here</p>", 10, "<p>some words...</p>")
+	test("<p>some words, here</p>", 13, "<p>some words...</p>")
+	test("<p>ééé ééé ééé</p>", 9, "<p>ééé ééé...</p>")
+	test("<p>日本語の文章</p>", 3, "<p>日本語...</p>")
+	test("<p>one <b>two three</b> four</p>\n<p>five</p>", 10, "<p>one <b>two...</b></p>")
+	test("<p>one</p>\n<p>two</p>", 3, "<p>one</p>")
+}
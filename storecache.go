@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The store is read from disk once and then kept in memory. Mutations through
+// the admin call storeChanged. A goroutine polls the data directory for
+// changes made outside of blogx, e.g. files edited by hand.
+
+const storePollInterval = 2 * time.Second
+
+var storeCache struct {
+	sync.Mutex
+	st    *store // Nil if it has to be read again.
+	stamp string // Fingerprint of the data directory.
+}
+
+// loadStore returns the in-memory store, reading it from disk if needed. The
+// store is shared between requests and must not be modified. Mutations must
+// use readStore while holding storeLock instead.
+func loadStore() (*store, error) {
+	storeCache.Lock()
+	defer storeCache.Unlock()
+
+	if storeCache.st == nil {
+		st, err := readStore()
+		if err != nil {
+			return nil, err
+		}
+		storeCache.st = st
+	}
+	return storeCache.st, nil
+}
+
+// storeChanged must be called with storeLock held, after changing files in the
+// data directory.
+func storeChanged() {
+	stamp, err := dataStamp()
+	if err != nil {
+		log.Printf("fingerprinting data directory: %v", err)
+	}
+
+	storeCache.Lock()
+	defer storeCache.Unlock()
+	storeCache.st = nil
+	storeCache.stamp = stamp
+	wakeScheduler()
+}
+
+// watchStore periodically checks if files in the data directory have changed.
+// If so, or if the theme directory changed, the in-memory store and all cached
+// pages are dropped.
+func watchStore() {
+	for {
+		time.Sleep(storePollInterval)
+
+		storeLock.Lock()
+		stamp, err := dataStamp()
+		if err != nil {
+			log.Printf("fingerprinting data directory: %v", err)
+			storeLock.Unlock()
+			continue
+		}
+		storeCache.Lock()
+		changed := stamp != storeCache.stamp
+		if changed {
+			storeCache.st = nil
+			storeCache.stamp = stamp
+		}
+		storeCache.Unlock()
+		if changed {
+			log.Printf("data or theme directory changed on disk, dropping cached store and pages")
+			removeAllWritethrough()
+			wakeScheduler()
+		}
+		storeLock.Unlock()
+	}
+}
+
+// dataStamp returns a fingerprint of the names, sizes and modification times of
+// all files in the data directory, excluding the cached pages in data/www and
+// images in data/cache, and in the theme directory, so cached pages are also dropped when the theme
+// changes.
+func dataStamp() (string, error) {
+	h := sha256.New()
+	dirs := []string{"data"}
+	if config.ThemeDir != "" {
+		dirs = append(dirs, config.ThemeDir)
+	}
+	for _, dir := range dirs {
+		if err := stampDir(h, dir); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func stampDir(h io.Writer, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "data/www" || path == "data/cache" {
+			return fs.SkipDir
+		}
+		if strings.HasPrefix(d.Name(), ".") || d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Tags can be used in URLs and file names in data/www, so are restricted to
+// letters, digits, dashes and underscores.
+var tagRegexp = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+
+// parseTags parses a comma-separated list of tags. Tags are lowercased, and
+// spaces are replaced by dashes. The returned tags are sorted and unique.
+func parseTags(s string) ([]string, error) {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.Join(strings.Fields(t), "-"))
+		if t == "" {
+			continue
+		}
+		if !tagRegexp.MatchString(t) {
+			return nil, fmt.Errorf("invalid tag %q, only letters, digits, dashes and underscores are allowed", t)
+		}
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return compactStrings(tags), nil
+}
+
+// compactStrings removes consecutive duplicates from a sorted list.
+func compactStrings(l []string) []string {
+	var r []string
+	for i, s := range l {
+		if i == 0 || s != l[i-1] {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+func (p *post) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TagList returns the tags as comma-separated list, as edited in the admin.
+func (p *post) TagList() string {
+	return strings.Join(p.Tags, ", ")
+}
+
+func tag2url(tag string) string {
+	return fmt.Sprintf("%st/%s/", baseURL.Path, tag)
+}
+
+type tagCount struct {
+	Tag   string
+	Count int
+	Size  int // From 1 to 4, for font size in a tag cloud.
+}
+
+// tagCloud returns the tags used in posts, sorted by name.
+func tagCloud(posts []*post) []tagCount {
+	counts := map[string]int{}
+	for _, p := range posts {
+		for _, t := range p.Tags {
+			counts[t]++
+		}
+	}
+	var l []tagCount
+	low, high := 0, 0
+	for t, n := range counts {
+		l = append(l, tagCount{Tag: t, Count: n})
+		if low == 0 || n < low {
+			low = n
+		}
+		if n > high {
+			high = n
+		}
+	}
+	for i := range l {
+		l[i].Size = 1
+		if high > low {
+			l[i].Size += 3 * (l[i].Count - low) / (high - low)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Tag < l[j].Tag
+	})
+	return l
+}
+
+// publicTag serves the listing and the atom feed for the posts with a tag.
+func publicTag(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len("t/"):]
+
+	l := strings.Split(path, "/")
+	tag := l[0]
+	if tag == "" {
+		http.Redirect(w, r, config.BaseURL, http.StatusMovedPermanently)
+		return
+	}
+	if !tagRegexp.MatchString(tag) {
+		abort(404)
+	}
+	if len(l) == 1 {
+		http.Redirect(w, r, fmt.Sprintf("%st/%s/", config.BaseURL, tag), http.StatusMovedPermanently)
+		return
+	}
+	if len(l) != 2 {
+		abort(404)
+	}
+
+	needGet(r)
+
+	data, err := loadStore()
+	httpCheck(err)
+
+	posts := []*post{}
+	for _, p := range data.publishedPosts() {
+		if p.HasTag(tag) {
+			posts = append(posts, p)
+		}
+	}
+	if len(posts) == 0 {
+		abort(404)
+	}
+
+	switch l[1] {
+	case "":
+		servePage(w, "t/index.html", map[string]interface{}{
+			"tag":   tag,
+			"posts": posts,
+			"tags":  tagCloud(data.publishedPosts()),
+		}, newImageBudget(config.PageBudget), fmt.Sprintf("data/www/t/%s/index.html", tag))
+	case "feed.atom":
+		serveFeed(w, posts, config.BlogTitle+" - "+tag, config.BaseURL+"t/"+tag+"/", fmt.Sprintf("data/www/t/%s/feed.atom", tag))
+	default:
+		abort(404)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	imagelib "image"
-	"io"
+	"io/fs"
 	"os"
 	"strings"
 	"time"
@@ -52,20 +52,23 @@ func formatDate(tm time.Time) string {
 }
 
 func inlineCSS(path string) template.CSS {
-	f, err := fsys.Open("assets/" + path)
-	httpCheck(err)
-	defer f.Close()
-	buf, err := io.ReadAll(f)
+	buf, err := fs.ReadFile(assetFS(), path)
 	httpCheck(err)
 	return template.CSS(string(buf))
 }
 
+// image2img returns an Img for ximage, it is only decoded when needed.
 func image2img(ximage *image) *Img {
-	data, err := ximage.Data()
-	httpCheck(err)
-	img, format, err := imagelib.Decode(bytes.NewBuffer(data))
-	httpCheck(err)
-	return &Img{img: img, format: format}
+	var format string
+	switch ximage.Mimetype {
+	case "image/jpeg":
+		format = "jpeg"
+	case "image/png":
+		format = "png"
+	default:
+		format = strings.TrimPrefix(ximage.Mimetype, "image/")
+	}
+	return &Img{source: ximage, format: format}
 }
 
 func imagePath(path string) *Img {
@@ -74,7 +77,7 @@ func imagePath(path string) *Img {
 	defer f.Close()
 	img, format, err := imagelib.Decode(f)
 	httpCheck(err)
-	return &Img{img: img, format: format}
+	return &Img{base: img, format: format}
 }
 
 func imageSlug(slug string) *Img {
@@ -82,7 +85,7 @@ func imageSlug(slug string) *Img {
 }
 
 func imageSlugRaw(slug string) *image {
-	data, err := readStore() // todo: don't read this again, it's already in memory somewhere
+	data, err := loadStore()
 	httpCheck(err)
 	ximage := data.findImageBySlug(slug)
 	if ximage == nil {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A theme directory, set with ThemeDir in the config, overrides the embedded
+// templates and static files in assets/. Its files have the same paths, e.g.
+// t/post.html and s/css/style.css. Files not in the theme directory are read
+// from the embedded assets, so a theme only needs the files it changes.
+
+// overlayFS opens files from dir, falling back to fallback for files that do
+// not exist in dir.
+type overlayFS struct {
+	dir      fs.FS
+	fallback fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return o.fallback.Open(name)
+	}
+	return f, err
+}
+
+// embeddedAssets returns the assets compiled into the binary.
+func embeddedAssets() fs.FS {
+	sfs, err := fs.Sub(fsys, "assets")
+	if err != nil {
+		panic(err)
+	}
+	return sfs
+}
+
+// assetFS returns the templates and static files, from the theme directory if
+// configured, with the embedded assets as fallback.
+func assetFS() fs.FS {
+	if config.ThemeDir == "" {
+		return embeddedAssets()
+	}
+	return overlayFS{os.DirFS(config.ThemeDir), embeddedAssets()}
+}
+
+func themeInit(args []string) {
+	fl := flag.NewFlagSet("theme-init", flag.ExitOnError)
+	fl.Usage = func() {
+		log.Printf("usage: blogx theme-init dir")
+		log.Printf("Copies the default templates and static files to dir, to start a theme for ThemeDir in the config. Existing files are not overwritten, so running it again adds files new in this version.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	args = fl.Args()
+	if len(args) != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+	dir := args[0]
+
+	var ncopied, nskipped int
+	err := fs.WalkDir(embeddedAssets(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0755)
+		}
+		buf, err := fs.ReadFile(fsys, "assets/"+path)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil && os.IsExist(err) {
+			log.Printf("%s already exists, skipped", dst)
+			nskipped++
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := f.Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+		ncopied++
+		return f.Close()
+	})
+	check(err, "copying assets")
+	log.Printf("%d files copied, %d skipped", ncopied, nskipped)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTheme(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	dir := t.TempDir()
+	config.ThemeDir = dir
+	write := func(path, s string) {
+		t.Helper()
+		p := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("s/css/style.css", "body{color:red}")
+	write("t/empty.html", `{{define "x"}}{{end}}themed {{.}}`)
+
+	if s := string(inlineCSS("s/css/style.css")); s != "body{color:red}" {
+		t.Fatalf("inlineCSS from theme: got %q", s)
+	}
+	if s := string(inlineCSS("s/css/reset.css")); !strings.Contains(s, "margin") {
+		t.Fatalf("inlineCSS fallback to embedded: got %q", s)
+	}
+	var b strings.Builder
+	if err := parseTemplate("t/empty.html").Execute(&b, "page"); err != nil || b.String() != "themed page" {
+		t.Fatalf("parseTemplate from theme: got %q, %v", b.String(), err)
+	}
+
+	themeProblems := func() []string {
+		var msgs []string
+		for _, p := range fsckConfig("blogx.conf") {
+			if strings.HasPrefix(p.Msg, dir) {
+				msgs = append(msgs, strings.TrimPrefix(p.Msg, dir))
+			}
+		}
+		return msgs
+	}
+	if msgs := themeProblems(); len(msgs) != 0 {
+		t.Fatalf("fsck of valid theme: got %q", msgs)
+	}
+	write("t/nope.html", "x")
+	write("t/post.html", "{{if}}")
+	if msgs := themeProblems(); len(msgs) != 2 || !strings.Contains(msgs[0], "nope.html: template does not override") || !strings.Contains(msgs[1], "post.html: parsing template") {
+		t.Fatalf("fsck of bad theme: got %q", msgs)
+	}
+
+	// theme-init copies the embedded assets, keeping existing files.
+	themeInit([]string{dir})
+	if buf, err := os.ReadFile(filepath.Join(dir, "s/css/style.css")); err != nil || string(buf) != "body{color:red}" {
+		t.Fatalf("theme-init overwrote existing file: %q, %v", buf, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "t/admin/post.html")); err != nil {
+		t.Fatalf("theme-init did not copy admin template: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Videos are uploaded like images, but are too large to inline in pages. They
+// are served at <baseurl>v/<slug>, with support for range requests so browsers
+// can seek and fetch them in parts. A poster image, shown until the video
+// plays, can be uploaded with the video and is inlined.
+
+func videoURL(slug string) string {
+	return config.BaseURL + "v/" + url.PathEscape(slug)
+}
+
+func (img *image) isVideo() bool {
+	return strings.HasPrefix(img.Mimetype, "video/")
+}
+
+// publicVideo serves a video by its slug.
+func publicVideo(w http.ResponseWriter, r *http.Request) {
+	needGet(r)
+	slug := strings.TrimPrefix(r.URL.Path, "v/")
+	data, err := loadStore()
+	httpCheck(err)
+	img := data.findImageBySlug(slug)
+	if img == nil || !img.isVideo() {
+		abort(404)
+	}
+	serveVideo(w, r, img)
+}
+
+// serveVideo serves the data file of img, without reading it into memory.
+func serveVideo(w http.ResponseWriter, r *http.Request, img *image) {
+	f, err := os.Open("data/image/" + img.ID + "/" + img.Filename)
+	httpCheck(err)
+	defer f.Close()
+	w.Header().Set("Content-Type", img.Mimetype)
+	// Data files are never changed, the ID identifies the contents.
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, img.ID))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, "", img.Time, f)
+}
+
+// posterURL returns a data URL for the poster of video img, or an empty string
+// if it has none.
+func posterURL(img *image) string {
+	if img.Poster == "" {
+		return ""
+	}
+	buf, err := img.PosterData()
+	httpCheck(err)
+	mimetype, _ := imageFileType(img.Poster)
+	return fmt.Sprintf("data:%s;base64,%s", mimetype, base64.StdEncoding.EncodeToString(buf))
+}
+
+// videoOptions are the options for video, with the attributes they add.
+var videoOptions = map[string]string{
+	"controls": " controls",
+	"muted":    " muted",
+	"loop":     " loop",
+	// Browsers only autoplay muted videos, and on mobile only when inline.
+	"autoplay": " autoplay playsinline",
+}
+
+// video returns a <video> element for video o, with options a space-separated
+// list of controls, muted, loop and autoplay.
+func video(options string, o interface{}) template.HTML {
+	var img *image
+	switch x := o.(type) {
+	case *image:
+		img = x
+	case *Img:
+		img = x.source
+	}
+	if img == nil || !img.isVideo() {
+		abortUserError(fmt.Sprintf("Unexpected input %T to video, must be a video.", o))
+	}
+	attrs := fmt.Sprintf(` src="%s" preload="metadata"`, html.EscapeString(videoURL(img.Slug)))
+	if s := posterURL(img); s != "" {
+		attrs += fmt.Sprintf(` poster="%s"`, s)
+	}
+	for _, opt := range strings.Fields(options) {
+		a, ok := videoOptions[opt]
+		if !ok {
+			abortUserError(fmt.Sprintf("Unknown video option %q, must be controls, muted, loop or autoplay.", opt))
+		}
+		attrs += a
+	}
+	if img.Title != "" {
+		attrs += fmt.Sprintf(` title="%s"`, html.EscapeString(img.Title))
+	}
+	// The link is only shown by browsers that cannot play the video.
+	return template.HTML(fmt.Sprintf(`<video%s><a href="%s">%s</a></video>`, attrs, html.EscapeString(videoURL(img.Slug)), html.EscapeString(img.AltText())))
+}
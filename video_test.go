@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVideo(t *testing.T) {
+	testDataDir(t)
+
+	clip := &image{ID: "x", Slug: "clip", Title: "A <clip>", Mimetype: "video/mp4", Filename: "data.mp4", Time: time.Now()}
+	s := string(video("controls muted loop", clip))
+	for _, x := range []string{`src="https://example.org/v/clip"`, " controls", " muted", " loop", `title="A &lt;clip&gt;"`, `<a href="https://example.org/v/clip">A &lt;clip&gt;</a>`} {
+		if !strings.Contains(s, x) {
+			t.Fatalf("video: %q does not contain %q", s, x)
+		}
+	}
+	if strings.Contains(s, "poster") || strings.Contains(s, "autoplay") {
+		t.Fatalf("video: unexpected attribute in %q", s)
+	}
+	if s := string(inlineImage(clip)); s != "https://example.org/v/clip" {
+		t.Fatalf("inlineImage of video: got %q, expected video URL", s)
+	}
+
+	mustPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: expected error", name)
+			}
+		}()
+		fn()
+	}
+	mustPanic("unknown option", func() { video("fullscreen", clip) })
+	mustPanic("not a video", func() { video("", &image{Mimetype: "image/png"}) })
+
+	// Range requests on the data file.
+	if err := writeImageData(clip, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/v/clip", nil)
+	r.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	serveVideo(w, r, clip)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Type") != "video/mp4" {
+		t.Fatalf("range request: got status %d, body %q, content-type %q", w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+	}
+	r = httptest.NewRequest("GET", "/v/clip", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	serveVideo(w, r, clip)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("conditional request: got status %d, expected 304", w.Code)
+	}
+}
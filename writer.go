@@ -1,15 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"log"
 	mathrand "math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var idgen = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
 
+// storeLock serializes all mutations of the data directory, including the read
+// of the store that a mutation is based on.
+var storeLock storeLocker
+
+// storeLocker is a mutex that also holds a lock on the file data/.lock while
+// locked, so commands like "blogx backup" can exclude a running "blogx serve".
+type storeLocker struct {
+	mu sync.Mutex
+	f  *os.File // Opened on first use, once the data directory exists.
+}
+
+func (l *storeLocker) Lock() {
+	l.mu.Lock()
+	if l.f == nil {
+		f, err := os.OpenFile("data/.lock", os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("opening lock file: %v", err)
+			}
+			return
+		}
+		l.f = f
+	}
+	if err := lockFile(l.f); err != nil {
+		log.Printf("locking data directory: %v", err)
+	}
+}
+
+func (l *storeLocker) Unlock() {
+	if l.f != nil {
+		if err := unlockFile(l.f); err != nil {
+			log.Printf("unlocking data directory: %v", err)
+		}
+	}
+	l.mu.Unlock()
+}
+
 func newID() string {
 	const characters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
@@ -20,8 +63,71 @@ func newID() string {
 	return string(buf)
 }
 
+// writeFileAtomic replaces path with data. The data is written to a temporary
+// file in the same directory, synced and renamed over path, after which the
+// directory itself is synced. Readers either see the old or the new file, never
+// a partially written one.
+func writeFileAtomic(path string, data []byte) (rerr error) {
+	dir := filepath.Dir(path)
+	if err := ensureDir(dir); err != nil {
+		return err
+	}
+
+	// Temporary files start with a dot, readers of the data directory skip them.
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// ensureDir creates dir and its missing parents, syncing each parent so the new
+// directory entries are durable.
+func ensureDir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := ensureDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0777); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return syncDir(filepath.Dir(dir))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 type writer struct {
-	f *os.File
+	buf bytes.Buffer
 }
 
 type writeError struct{ error }
@@ -53,45 +159,106 @@ func (w *writer) Linef(format string, args ...interface{}) {
 	w.Text(fmt.Sprintf(format, args...) + "\n")
 }
 
-func (w *writer) Time(tm time.Time) {
-	w.Text(tm.Format(time.RFC3339) + "\n")
+// Header writes a "Key: value" line of a v2 file.
+func (w *writer) Header(key, value string) {
+	if strings.ContainsAny(value, "\r\n") {
+		w.errorf("header %q: value cannot contain newlines", key)
+	}
+	w.Linef("%s: %s", key, value)
+}
+
+// OptHeader writes a header line, unless value is empty.
+func (w *writer) OptHeader(key, value string) {
+	if value != "" {
+		w.Header(key, value)
+	}
+}
+
+func (w *writer) Bool(key string, v bool, falseVal, trueVal string) {
+	if v {
+		w.Header(key, trueVal)
+	} else {
+		w.Header(key, falseVal)
+	}
+}
+
+// Flag writes a header with value "yes" if v is set.
+func (w *writer) Flag(key string, v bool) {
+	if v {
+		w.Header(key, "yes")
+	}
+}
+
+func (w *writer) OptInt(key string, v int) {
+	if v != 0 {
+		w.Header(key, strconv.Itoa(v))
+	}
+}
+
+func (w *writer) Time(key string, tm time.Time) {
+	w.Header(key, tm.Format(time.RFC3339))
+}
+
+func (w *writer) OptTime(key string, tm time.Time) {
+	if !tm.IsZero() {
+		w.Time(key, tm)
+	}
 }
 
 func (w *writer) Text(s string) {
-	_, err := w.f.Write([]byte(s))
-	w.check(err, "write")
+	w.buf.WriteString(s)
 }
 
-func writePost(p *post) (rerr error) {
+// marshalPost returns the contents of post.txt for p.
+func marshalPost(p *post) (buf []byte, rerr error) {
 	w := &writer{}
 	defer w.handle(&rerr)
 
 	if p.ID == "" {
 		w.errorf("missing ID")
 	}
-	path := fmt.Sprintf("data/post/%s/post.txt", p.ID)
-	os.MkdirAll(filepath.Dir(path), 0777)
-	f, err := os.Create(path)
-	w.check(err, "create post file")
-	w.f = f
-	w.Linef("v1")
-	w.Linef("%s", p.ID)
-	if p.Active {
-		w.Linef("active")
-	} else {
-		w.Linef("inactive")
+	w.Linef("v2")
+	w.Header("ID", p.ID)
+	w.Bool("Status", p.Active, "inactive", "active")
+	w.Header("Slug", p.Slug)
+	for _, slug := range p.OldSlugs {
+		w.Header("Old-Slug", slug)
 	}
-	w.Linef("%s", p.Slug)
-	w.Linef("%s", p.Title)
-	w.Time(p.Time)
+	w.Header("Title", p.Title)
+	w.Time("Time", p.Time)
+	w.OptTime("Publish", p.Publish)
+	w.OptTime("Expire", p.Expire)
+	w.OptTime("Updated", p.Updated)
+	w.OptHeader("Author", p.Author)
+	w.OptHeader("Tags", strings.Join(p.Tags, ", "))
+	w.OptHeader("Summary", p.Summary)
+	w.OptInt("Page-Budget", p.PageBudget)
+	w.Flag("Legacy-Templates", p.LegacyTemplates)
 	w.Linef("body:")
 	w.Text(p.Body)
-	err = f.Close()
-	w.check(err, "close post")
-	return
+	return w.buf.Bytes(), nil
 }
 
-func writeComment(c *comment) (rerr error) {
+// postVersion returns a token for the current contents of a post, for
+// detecting concurrent edits. Comments are not part of it.
+func postVersion(p *post) string {
+	buf, err := marshalPost(p)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(buf)
+	return fmt.Sprintf("%x", h[:16])
+}
+
+func writePost(p *post) error {
+	buf, err := marshalPost(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fmt.Sprintf("data/post/%s/post.txt", p.ID), buf)
+}
+
+func marshalComment(c *comment) (buf []byte, rerr error) {
 	w := &writer{}
 	defer w.handle(&rerr)
 
@@ -101,68 +268,59 @@ func writeComment(c *comment) (rerr error) {
 	if c.PostID == "" {
 		w.errorf("empty PostID on comment")
 	}
-	path := fmt.Sprintf("data/post/%s/comment/%s.txt", c.PostID, c.ID)
-	os.MkdirAll(filepath.Dir(path), 0777)
-	f, err := os.Create(path)
-	w.check(err, "create comment file")
-	w.f = f
-	w.Linef("v1")
-	w.Linef("%s", c.ID)
-	if c.Active {
-		w.Linef("active")
-	} else {
-		w.Linef("inactive")
-	}
-	if c.Seen {
-		w.Linef("seen")
-	} else {
-		w.Linef("notseen")
-	}
-	w.Time(c.Time)
-	w.Linef("%s", c.Author)
+	w.Linef("v2")
+	w.Header("ID", c.ID)
+	w.Bool("Status", c.Active, "inactive", "active")
+	w.Bool("Seen", c.Seen, "no", "yes")
+	w.Time("Time", c.Time)
+	w.Header("Author", c.Author)
+	w.OptHeader("Address", c.Address)
+	w.OptHeader("User-Agent", c.UserAgent)
 	w.Linef("body:")
 	w.Text(c.Body)
-	err = f.Close()
-	w.check(err, "close comment")
-	return
+	return w.buf.Bytes(), nil
+}
+
+func writeComment(c *comment) error {
+	buf, err := marshalComment(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fmt.Sprintf("data/post/%s/comment/%s.txt", c.PostID, c.ID), buf)
 }
 
-func writeImage(img *image) (rerr error) {
+func marshalImage(img *image) (buf []byte, rerr error) {
 	w := &writer{}
 	defer w.handle(&rerr)
 
 	if img.ID == "" {
 		w.errorf("missing ID")
 	}
-	path := fmt.Sprintf("data/image/%s/image.txt", img.ID)
-	os.MkdirAll(filepath.Dir(path), 0777)
-	f, err := os.Create(path)
-	w.check(err, "create image file")
-	w.f = f
-	w.Linef("v1")
-	w.Linef("%s", img.ID)
-	w.Linef("%s", img.Slug)
-	w.Linef("%s", img.Title)
-	w.Time(img.Time)
-	w.Linef("%s", img.Mimetype)
-	w.Linef("%s", img.Filename)
-	err = f.Close()
-	w.check(err, "close image")
-	return
-}
-
-func writeImageData(img *image, data []byte) (rerr error) {
-	w := &writer{}
-	defer w.handle(&rerr)
+	w.Linef("v2")
+	w.Header("ID", img.ID)
+	w.Header("Slug", img.Slug)
+	w.Header("Title", img.Title)
+	w.OptHeader("Alt", img.Alt)
+	w.Time("Time", img.Time)
+	w.Header("Mimetype", img.Mimetype)
+	w.Header("Filename", img.Filename)
+	w.OptTime("Captured", img.Captured)
+	w.OptHeader("Poster", img.Poster)
+	return w.buf.Bytes(), nil
+}
 
-	path := fmt.Sprintf("data/image/%s/%s", img.ID, img.Filename)
-	os.MkdirAll(filepath.Dir(path), 0777)
+func writeImage(img *image) error {
+	buf, err := marshalImage(img)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fmt.Sprintf("data/image/%s/image.txt", img.ID), buf)
+}
+
+func writeImageData(img *image, data []byte) error {
+	return writeFileAtomic(fmt.Sprintf("data/image/%s/%s", img.ID, img.Filename), data)
+}
 
-	df, err := os.Create(path)
-	w.check(err, "create image data file")
-	_, err = df.Write(data)
-	w.check(err, "writing image data")
-	err = df.Close()
-	w.check(err, "closing image data")
-	return
+func writePosterData(img *image, data []byte) error {
+	return writeFileAtomic(fmt.Sprintf("data/image/%s/%s", img.ID, img.Poster), data)
 }
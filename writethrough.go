@@ -12,4 +12,17 @@ func removeWritethrough(filename string) {
 	}
 	os.Remove("data/www/index.html")
 	os.Remove("data/www/feed.atom")
+	os.RemoveAll("data/www/t")
+}
+
+// removeAllWritethrough removes all cached pages, they are generated again on
+// the next request.
+func removeAllWritethrough() {
+	l, err := os.ReadDir("data/www")
+	if err != nil {
+		return
+	}
+	for _, fi := range l {
+		os.RemoveAll("data/www/" + fi.Name())
+	}
 }
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WordPress eXtended RSS, as exported by WordPress. Elements in the wp
+// namespace are matched by local name only, the namespace includes a version
+// that differs between WordPress releases.
+type wxr struct {
+	Channel struct {
+		Link        string    `xml:"link"`
+		BaseSiteURL string    `xml:"base_site_url"`
+		Items       []wxrItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type wxrItem struct {
+	Title         string        `xml:"title"`
+	Link          string        `xml:"link"`
+	Creator       string        `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Content       string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID        int           `xml:"post_id"`
+	PostDate      string        `xml:"post_date"`
+	PostDateGMT   string        `xml:"post_date_gmt"`
+	PostName      string        `xml:"post_name"`
+	Status        string        `xml:"status"`
+	PostParent    int           `xml:"post_parent"`
+	PostType      string        `xml:"post_type"`
+	AttachmentURL string        `xml:"attachment_url"`
+	Categories    []wxrCategory `xml:"category"`
+	Comments      []wxrComment  `xml:"comment"`
+}
+
+type wxrCategory struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+type wxrComment struct {
+	ID       int    `xml:"comment_id"`
+	Author   string `xml:"comment_author"`
+	AuthorIP string `xml:"comment_author_IP"`
+	Date     string `xml:"comment_date"`
+	DateGMT  string `xml:"comment_date_gmt"`
+	Content  string `xml:"comment_content"`
+	Approved string `xml:"comment_approved"`
+	Type     string `xml:"comment_type"`
+}
+
+// wxrTime parses a WordPress time, preferring the GMT version. Unpublished
+// posts have a zero GMT time.
+func wxrTime(gmt, local string) (time.Time, error) {
+	const layout = "2006-01-02 15:04:05"
+	if gmt != "" && !strings.HasPrefix(gmt, "0000-") {
+		return time.Parse(layout, gmt)
+	}
+	return time.ParseInLocation(layout, local, time.Local)
+}
+
+// wxrImage is an attachment that will be imported as image.
+type wxrImage struct {
+	img  *image
+	url  *url.URL
+	data []byte
+}
+
+var (
+	wxrImgRegexp       = regexp.MustCompile(`(?i)<img\s[^>]*src="([^"]+)"[^>]*>`)
+	wxrLinkedImgRegexp = regexp.MustCompile(`(?i)<a\s[^>]*href="([^"]+)"[^>]*>\s*(<img\s[^>]*src="[^"]+"[^>]*>)\s*</a>`)
+	wxrAltRegexp       = regexp.MustCompile(`(?i)\salt="([^"]*)"`)
+	wxrSizedRegexp     = regexp.MustCompile(`^(.*)-([0-9]+)x([0-9]+)(\.[a-zA-Z0-9]+)$`)
+	wxrCaptionRegexp   = regexp.MustCompile(`\[/?caption[^\]]*\]`)
+	wxrSlugRegexp      = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+	wxrPostNameRegexp  = regexp.MustCompile(`^[\p{L}\p{N}_-]+$`)
+)
+
+// wxrHTTPClient fetches attachments, a server that does not respond must not
+// hang the import.
+var wxrHTTPClient = &http.Client{Timeout: time.Minute}
+
+func importWXR(args []string) {
+	fl := flag.NewFlagSet("import-wxr", flag.ExitOnError)
+	dryrun := fl.Bool("dryrun", false, "Only report what would be imported")
+	uploads := fl.String("uploads", "", "Local copy of the wp-content/uploads directory to read attachments from")
+	fetch := fl.Bool("fetch", false, "Fetch attachments not found in -uploads from their URL")
+	redirects := fl.Bool("redirects", true, "Add redirects from the WordPress URLs of posts to the imported posts")
+	fl.Usage = func() {
+		log.Printf("usage: blogx import-wxr [flags] export.xml")
+		log.Printf("Imports posts, comments and attached images from a WordPress export into the data directory in the current directory. Stop blogx serve first.")
+		fl.PrintDefaults()
+	}
+	fl.Parse(args)
+	args = fl.Args()
+	if len(args) != 1 {
+		fl.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(args[0])
+	check(err, "open export")
+	var doc wxr
+	err = xml.NewDecoder(f).Decode(&doc)
+	check(err, "parsing export")
+	f.Close()
+
+	for _, dir := range []string{"data/post", "data/image", "data/www"} {
+		check(ensureDir(dir), "creating data directory")
+	}
+	data, err := readStore()
+	check(err, "reading store")
+
+	siteURL := doc.Channel.BaseSiteURL
+	if siteURL == "" {
+		siteURL = doc.Channel.Link
+	}
+	base, err := url.Parse(siteURL)
+	check(err, "parsing site url")
+
+	// Attachments first, posts refer to them.
+	imageSlugs := map[string]bool{}
+	for _, img := range data.Images {
+		imageSlugs[img.Slug] = true
+	}
+	images := map[string]*wxrImage{} // By URL path.
+	for _, it := range doc.Channel.Items {
+		if it.PostType != "attachment" || it.AttachmentURL == "" {
+			continue
+		}
+		u, err := url.Parse(it.AttachmentURL)
+		if err != nil {
+			log.Printf("attachment %d: bad url %q, skipping", it.PostID, it.AttachmentURL)
+			continue
+		}
+		mimetype, ext := imageFileType(u.Path)
+		if mimetype == "" {
+			log.Printf("attachment %d: unsupported file type %q, skipping", it.PostID, u.Path)
+			continue
+		}
+		slug := wxrSlug(it.PostName, it.Title, it.PostID)
+		for imageSlugs[slug] {
+			slug += "-" + strconv.Itoa(it.PostID)
+		}
+		tm, err := wxrTime(it.PostDateGMT, it.PostDate)
+		if err != nil {
+			tm = time.Now()
+		}
+		wi := &wxrImage{
+			img: &image{
+				ID:       newID(),
+				Time:     tm,
+				Slug:     slug,
+				Title:    it.Title,
+				Mimetype: mimetype,
+				Filename: "data." + ext,
+			},
+			url: u,
+		}
+		wi.data, err = wxrAttachment(u, *uploads, *fetch)
+		if err != nil {
+			log.Printf("attachment %d: %v, skipping", it.PostID, err)
+			continue
+		}
+		imageSlugs[slug] = true
+		images[u.Path] = wi
+	}
+
+	postSlugs := map[string]bool{}
+	for _, p := range data.Posts {
+		postSlugs[p.Slug] = true
+		for _, s := range p.OldSlugs {
+			postSlugs[s] = true
+		}
+	}
+	redirectFroms := map[string]bool{}
+	for _, rd := range data.Redirects {
+		redirectFroms[rd.From] = true
+	}
+	newRedirects := data.Redirects
+	var posts []*post
+	for _, it := range doc.Channel.Items {
+		if it.PostType != "post" {
+			if it.PostType != "attachment" {
+				log.Printf("item %d: skipping %s %q", it.PostID, it.PostType, it.Title)
+			}
+			continue
+		}
+		tm, err := wxrTime(it.PostDateGMT, it.PostDate)
+		if err != nil {
+			log.Printf("post %d: bad date: %v, skipping", it.PostID, err)
+			continue
+		}
+		p := &post{
+			ID:     newID(),
+			Slug:   wxrSlug(it.PostName, it.Title, it.PostID),
+			Title:  it.Title,
+			Time:   tm,
+			Author: it.Creator,
+			Body:   wxrBody(it.Content, images),
+		}
+		switch it.Status {
+		case "publish":
+			p.Active = true
+		case "future":
+			p.Active = true
+			p.Publish = tm
+		case "draft", "pending", "private":
+		default:
+			log.Printf("post %d: skipping post with status %q", it.PostID, it.Status)
+			continue
+		}
+		if postSlugs[p.Slug] {
+			log.Printf("post %d: slug %q already exists, skipping", it.PostID, p.Slug)
+			continue
+		}
+		postSlugs[p.Slug] = true
+		if p.Author == config.BlogAuthor {
+			p.Author = ""
+		}
+
+		var tags []string
+		for _, c := range it.Categories {
+			if (c.Domain == "post_tag" || c.Domain == "category") && c.Nicename != "uncategorized" {
+				tags = append(tags, c.Name)
+			}
+		}
+		for _, t := range tags {
+			if l, err := parseTags(t); err != nil {
+				log.Printf("post %d: skipping tag: %v", it.PostID, err)
+			} else {
+				p.Tags = append(p.Tags, l...)
+			}
+		}
+		p.Tags, _ = parseTags(strings.Join(p.Tags, ","))
+
+		for _, c := range it.Comments {
+			if c.Type != "" && c.Type != "comment" {
+				continue
+			}
+			if c.Approved != "1" && c.Approved != "0" {
+				continue
+			}
+			ctm, err := wxrTime(c.DateGMT, c.Date)
+			if err != nil {
+				log.Printf("post %d, comment %d: bad date: %v, skipping", it.PostID, c.ID, err)
+				continue
+			}
+			p.Comments = append(p.Comments, &comment{
+				ID:      newID(),
+				PostID:  p.ID,
+				Active:  c.Approved == "1",
+				Seen:    c.Approved == "1",
+				Time:    ctm,
+				Author:  c.Author,
+				Address: c.AuthorIP,
+				Body:    c.Content,
+			})
+		}
+		posts = append(posts, p)
+
+		if !*redirects || !p.Active {
+			continue
+		}
+		froms := []string{fmt.Sprintf("?p=%d", it.PostID)}
+		if u, err := url.Parse(it.Link); err == nil && u.Host == base.Host && strings.HasPrefix(u.Path, base.Path) {
+			from := strings.TrimPrefix(strings.TrimPrefix(u.Path, base.Path), "/")
+			if u.RawQuery != "" {
+				from += "?" + u.RawQuery
+			}
+			froms = append(froms, from)
+		}
+		for _, from := range froms {
+			if from != "" && !redirectFroms[from] && !strings.ContainsAny(from, " \t") {
+				redirectFroms[from] = true
+				newRedirects = append(newRedirects, &redirect{from, "p/" + p.Slug + "/"})
+			}
+		}
+	}
+
+	nredirects := len(newRedirects) - len(data.Redirects)
+	if *dryrun {
+		for _, p := range posts {
+			log.Printf("would import post %q (%s), %d comments", p.Slug, p.Title, len(p.Comments))
+		}
+		log.Printf("would import %d posts, %d images and %d redirects", len(posts), len(images), nredirects)
+		return
+	}
+
+	for _, wi := range images {
+		check(writeImageData(wi.img, wi.data), "writing image data")
+		check(writeImage(wi.img), "writing image")
+	}
+	for _, p := range posts {
+		check(writePost(p), "writing post")
+		for _, c := range p.Comments {
+			check(writeComment(c), "writing comment")
+		}
+	}
+	if nredirects > 0 {
+		check(writeRedirects(newRedirects), "writing redirects")
+	}
+	removeAllWritethrough()
+	log.Printf("imported %d posts, %d images and %d redirects", len(posts), len(images), nredirects)
+}
+
+// wxrSlug returns a slug for an item, WordPress leaves post_name empty for drafts.
+// A post_name that is not a valid slug, e.g. with a slash, is replaced by a slug
+// from the title too.
+func wxrSlug(name, title string, id int) string {
+	if s, err := url.PathUnescape(name); err == nil && safeName(s) && wxrPostNameRegexp.MatchString(s) {
+		return s
+	}
+	s := strings.Trim(wxrSlugRegexp.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if s == "" {
+		s = fmt.Sprintf("wp-%d", id)
+	}
+	return s
+}
+
+// wxrAttachment reads the data of an attachment from the local uploads
+// directory, or fetches it.
+func wxrAttachment(u *url.URL, uploads string, fetch bool) ([]byte, error) {
+	if uploads != "" {
+		if _, rel, ok := strings.Cut(u.Path, "/wp-content/uploads/"); ok {
+			buf, err := os.ReadFile(filepath.Join(uploads, filepath.FromSlash(rel)))
+			if err == nil || !fetch {
+				return buf, err
+			}
+		}
+	}
+	if !fetch {
+		return nil, fmt.Errorf("not found, use -uploads or -fetch")
+	}
+	resp, err := wxrHTTPClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// wxrBody turns WordPress content into a post body. Shortcode tags in the
+// content are escaped, caption shortcodes removed, and img tags referencing
+// imported attachments replaced by image shortcodes. A link around such an
+// image is removed, the image shortcode links to the original.
+func wxrBody(s string, images map[string]*wxrImage) string {
+	s = strings.ReplaceAll(s, "{{<", `\{{<`)
+	s = wxrCaptionRegexp.ReplaceAllString(s, "")
+	s = wxrLinkedImgRegexp.ReplaceAllStringFunc(s, func(link string) string {
+		m := wxrLinkedImgRegexp.FindStringSubmatch(link)
+		u, err := url.Parse(m[1])
+		if err != nil {
+			return link
+		}
+		if wi, _, _ := wxrFindImage(u, images); wi == nil {
+			return link
+		}
+		if sc := wxrImageShortcode(m[2], images); sc != "" {
+			return sc
+		}
+		return link
+	})
+	return wxrImgRegexp.ReplaceAllStringFunc(s, func(tag string) string {
+		if sc := wxrImageShortcode(tag, images); sc != "" {
+			return sc
+		}
+		return tag
+	})
+}
+
+// wxrFindImage returns the imported image for the path of u, and the width and
+// height if u is for a resized version, like name-300x200.jpg.
+func wxrFindImage(u *url.URL, images map[string]*wxrImage) (wi *wxrImage, width, height string) {
+	wi = images[u.Path]
+	if wi == nil {
+		if m := wxrSizedRegexp.FindStringSubmatch(u.Path); m != nil {
+			wi = images[m[1]+m[4]]
+			width, height = m[2], m[3]
+		}
+	}
+	if wi == nil || !strings.HasPrefix(wi.img.Mimetype, "image/") {
+		return nil, "", ""
+	}
+	return wi, width, height
+}
+
+// wxrImageShortcode returns an image shortcode for img tag, or an empty string
+// if it does not reference an imported image.
+func wxrImageShortcode(tag string, images map[string]*wxrImage) string {
+	u, err := url.Parse(wxrImgRegexp.FindStringSubmatch(tag)[1])
+	if err != nil {
+		return ""
+	}
+	wi, width, height := wxrFindImage(u, images)
+	if wi == nil {
+		return ""
+	}
+	sc := "{{< image " + shortcodeArg(wi.img.Slug)
+	if width != "" {
+		sc += fmt.Sprintf(" w=%s h=%s", width, height)
+	}
+	if m := wxrAltRegexp.FindStringSubmatch(tag); m != nil && m[1] != "" {
+		sc += " alt=" + strconv.Quote(html.UnescapeString(m[1]))
+	}
+	return sc + " >}}"
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWXRSlug(t *testing.T) {
+	test := func(name, title string, exp string) {
+		t.Helper()
+		if s := wxrSlug(name, title, 12); s != exp {
+			t.Fatalf("wxrSlug %q, %q: got %q, expected %q", name, title, s, exp)
+		}
+	}
+
+	test("hello-world", "Hello world", "hello-world")
+	test("%c3%a9t%c3%a9", "Été", "été")
+	test("", "Hello, World!", "hello-world")
+	test("", "!!!", "wp-12")
+	test("a%2f..%2fb", "Sneaky", "sneaky")
+	test("..", "Dots", "dots")
+	test("%zz", "Bad escape", "bad-escape")
+	test("with space", "With space", "with-space")
+}